@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"misc.sahilsasane.net/internal/data"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func (app *application) uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	maxSize := app.config.attachments.maxSize
+
+	// Large uploads over slow connections need longer than the server's
+	// ReadTimeout. The response is only written once the upload is read,
+	// so the write deadline moves with it.
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(time.Minute)
+	err := rc.SetReadDeadline(deadline)
+	if err == nil {
+		err = rc.SetWriteDeadline(deadline.Add(30 * time.Second))
+	}
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
+	v := validator.New()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			v.AddError("file", fmt.Sprintf("must not be larger than %d bytes", maxSize))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, http.ErrMissingFile):
+			v.AddError("file", "must be provided")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The type is sniffed from the content; the declared type is only used
+	// for formats that cannot be sniffed, such as HEIC.
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(header.Header.Get("Content-Type"))
+	}
+
+	v.Check(len(content) > 0, "file", "must not be empty")
+	v.Check(int64(len(content)) <= maxSize, "file", fmt.Sprintf("must not be larger than %d bytes", maxSize))
+	v.Check(validator.In(mimeType, data.AttachmentMimeTypes...), "file", "must be a PNG, JPEG, WebP, HEIC or HEIF image, a PDF or a plain text file")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	attachment := &data.Attachment{
+		UserId:   app.contextGetUser(r).ID,
+		Filename: filepath.Base(header.Filename),
+		MimeType: mimeType,
+	}
+
+	err = app.models.Attachments.Insert(r.Context(), attachment, content)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"attachment": attachment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	attachment, err := app.models.Attachments.GetForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	content, err := app.models.Attachments.Content(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.MimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
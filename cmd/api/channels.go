@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"misc.sahilsasane.net/internal/data"
+	"misc.sahilsasane.net/internal/llm"
 	"misc.sahilsasane.net/internal/validator"
 )
 
@@ -13,14 +15,11 @@ func (app *application) getChannelHandler(w http.ResponseWriter, r *http.Request
 
 	id := app.readIDparam(r)
 
-	v := validator.New()
-
-	channel, err := app.models.Channel.GetById(id)
+	channel, err := app.getOwnedChannel(r, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("channel", "not found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -35,44 +34,129 @@ func (app *application) getChannelHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) getAllChannelSessionsHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		ChannelId string `json:"channel_id"`
+	id := app.readIDparam(r)
+
+	channel, err := app.getOwnedChannel(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	err := app.readJSON(w, r, &input)
+	sesssions := []string{}
+	for _, sessionID := range channel.Sessions {
+		sesssions = append(sesssions, sessionID.Hex())
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sesssions}, nil)
 	if err != nil {
-		app.badRequestResponse(w, r, err)
+		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
+
+func (app *application) createChannelHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	newChannelId := primitive.NewObjectID()
+
+	tree := &data.Tree{
+		ChannelId: newChannelId.Hex(),
+		Root:      "",
+	}
+
+	channel := &data.Channel{
+		ID:       newChannelId,
+		UserId:   user.ID.Hex(),
+		Sessions: []primitive.ObjectID{},
+	}
 
 	v := validator.New()
 
-	channel, err := app.models.Channel.GetById(input.ChannelId)
+	// The channel and its tree are created together or not at all.
+	var channelId string
+	err := app.models.Transaction(r.Context(), func(ctx context.Context) error {
+		_, err := app.models.Trees.Insert(ctx, tree)
+		if err != nil {
+			return err
+		}
+
+		channel.Tree = tree.ID
+		channelId, err = app.models.Channel.Insert(ctx, channel)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrCannotInsert):
+			v.AddError("channel", "not able to insert")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "Created channel successfully", "channel_id": channelId}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getChannelTreeHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	_, err := app.getOwnedChannel(r, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("channel", "not found")
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	sesssions := []string{}
-	for _, sessionID := range channel.Sessions {
-		sesssions = append(sesssions, sessionID.Hex())
+	tree, err := app.models.Trees.GetByChannelId(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sesssions}, nil)
+	sessions, err := app.models.Sessions.GetAllForChannel(r.Context(), id)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	env := envelope{
+		"channel_id": id,
+		"root":       tree.Root,
+		"tree":       data.BuildTree(sessions),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
-func (app *application) createChannelHandler(w http.ResponseWriter, r *http.Request) {
+// updateChannelInstructionsHandler sets the instructions inherited by every
+// session in the channel that does not override them.
+func (app *application) updateChannelInstructionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
 	var input struct {
-		UserId string `json:"user_id"`
+		Text      *string `json:"text"`
+		PersonaId string  `json:"persona_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -81,47 +165,89 @@ func (app *application) createChannelHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	newChannelId := primitive.NewObjectID()
-
-	tree := &data.Tree{
-		ChannelId: newChannelId.Hex(),
-		Root:      "",
+	channel, err := app.getOwnedChannel(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	treeId, err := app.models.Trees.Insert(tree)
+	v := validator.New()
+
+	text, err := app.instructionsText(r, v, input.Text, input.PersonaId)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	treeObjID, err := primitive.ObjectIDFromHex(treeId)
+	err = app.models.Channel.UpdateInstructions(r.Context(), channel, text, input.PersonaId)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	channel := &data.Channel{
-		ID:       newChannelId,
-		UserId:   input.UserId,
-		Sessions: []primitive.ObjectID{},
-		Tree:     treeObjID,
+	err = app.writeJSON(w, http.StatusOK, envelope{"channel_id": id, "instructions": channel.Instructions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateChannelGenerationHandler replaces the generation settings inherited
+// by the sessions in the channel. An empty object removes them.
+func (app *application) updateChannelGenerationHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	var input llm.GenerationConfig
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	v := validator.New()
 
-	channelId, err := app.models.Channel.Insert(channel)
+	if app.validateGeneration(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	channel, err := app.getOwnedChannel(r, id)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrCannotInsert):
-			v.AddError("channel", "not able to insert")
-			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "Created channel successfully", "channel_id": channelId}, nil)
+	err = app.models.Channel.UpdateGeneration(r.Context(), channel, input)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"channel_id": id, "generation": channel.Generation}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
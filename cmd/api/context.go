@@ -4,12 +4,25 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/pascaldekloe/jwt"
 	"misc.sahilsasane.net/internal/data"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	claimsContextKey      = contextKey("claims")
+	requestInfoContextKey = contextKey("requestInfo")
+)
+
+// requestInfo is filled in while a request is handled, so that the outermost
+// middleware can read it once the response has been written.
+type requestInfo struct {
+	id     string
+	route  string
+	userID string
+}
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +36,31 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	if !ok {
+		panic("missing claims value in request context")
+	}
+	return claims
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestInfo returns a throwaway value when the request did not
+// pass through the middleware that sets it, so writers never need to check.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok {
+		return &requestInfo{}
+	}
+	return info
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/metrics"
+)
+
+var errorsTotal = metrics.NewCounterVec(
+	"http_errors_total",
+	"Error responses by kind.",
+	"kind",
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestInfo(r).id,
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -14,6 +28,8 @@ func (app *application) logError(r *http.Request, err error) {
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 
+	errorsTotal.Inc(strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"))
+
 	env := envelope{"error": message}
 	err := app.writeJSON(w, status, env, nil)
 
@@ -56,11 +72,67 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// llmErrorResponse maps a failed model call to a response. Failures of the
+// provider itself are reported as gateway errors and logged, while a blocked
+// message is the client's to fix.
+func (app *application) llmErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := app.llmError(err)
+
+	if status == 0 {
+		// The client has gone away, so there is nobody to respond to.
+		return
+	}
+
+	if status != http.StatusUnprocessableEntity {
+		app.logError(r, err)
+	}
+
+	var apiErr *llm.APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(apiErr.RetryAfter)))
+	}
+
+	app.errorResponse(w, r, status, message)
+}
+
+// llmError returns the status and message for a failed model call. The
+// status is zero when the request was cancelled by the client.
+func (app *application) llmError(err error) (int, string) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return 0, ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "the language model took too long to respond"
+	case errors.Is(err, llm.ErrBlocked):
+		return http.StatusUnprocessableEntity, "the message or the reply was blocked by the language model's safety filters"
+	case errors.Is(err, llm.ErrUnsupportedPart):
+		return http.StatusUnprocessableEntity, "the language model does not support one of the attachments"
+	case errors.Is(err, llm.ErrUnsupportedSetting):
+		return http.StatusUnprocessableEntity, "the language model does not support one of the generation settings"
+	case errors.Is(err, llm.ErrRateLimited), errors.Is(err, llm.ErrUnavailable):
+		return http.StatusServiceUnavailable, "the language model is temporarily unavailable, please try again later"
+	case errors.Is(err, llm.ErrAuth), errors.Is(err, llm.ErrBadRequest), errors.Is(err, llm.ErrNoResponse):
+		return http.StatusBadGateway, "the language model could not process the request"
+	default:
+		return http.StatusInternalServerError, "the server encountered a problem and could not process your request"
+	}
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) sessionBusyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the session is still processing another message, please try again once it has finished"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) tokenBudgetExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "daily token budget exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentailsReponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -1,17 +1,26 @@
 package main
 
 import (
-	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"misc.sahilsasane.net/internal/data"
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/ratelimit"
+	"misc.sahilsasane.net/internal/validator"
 )
 
 type envelope map[string]interface{}
@@ -24,6 +33,32 @@ func (app *application) readIDparam(r *http.Request) string {
 	return id
 }
 
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	return s
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -43,6 +78,20 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+func (app *application) writeEvent(w http.ResponseWriter, rc *http.ResponseController, event string, data envelope) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	if err != nil {
+		return err
+	}
+
+	return rc.Flush()
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
@@ -91,117 +140,571 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
-func (app *application) getUpdatedTree(session *data.Session) (*data.Tree, error) {
-	tree, err := app.models.Trees.GetByChannelId(session.ChannelId)
+// getOwnedChannel returns the channel only if it belongs to the authenticated
+// user. Otherwise it returns ErrRecordNotFound so that other users' channels
+// look exactly like missing ones.
+func (app *application) getOwnedChannel(r *http.Request, id string) (*data.Channel, error) {
+	user := app.contextGetUser(r)
+	return app.models.Channel.GetForUser(r.Context(), id, user.ID)
+}
+
+// getOwnedSession returns the session only if its channel belongs to the
+// authenticated user.
+func (app *application) getOwnedSession(r *http.Request, id string) (*data.Session, error) {
+	session, err := app.models.Sessions.GetById(r.Context(), id)
 	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			return nil, data.ErrRecordNotFound
-		default:
-			return nil, err
+		return nil, err
+	}
+
+	_, err = app.getOwnedChannel(r, session.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// effectiveInstructions returns the instructions in effect for a session,
+// or nil when neither it, its ancestors nor its channel have any.
+func (app *application) effectiveInstructions(r *http.Request, session *data.Session) (*data.EffectiveInstructions, error) {
+	channel, err := app.getOwnedChannel(r, session.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.models.Sessions.EffectiveInstructions(r.Context(), session, channel)
+}
+
+// callOptions returns the options for a model call in a session: the
+// instructions in effect and its generation settings with override applied
+// on top. The model is always set, so that it can be recorded with the
+// reply.
+func (app *application) callOptions(r *http.Request, session *data.Session, override llm.GenerationConfig) (llm.Options, error) {
+	channel, err := app.getOwnedChannel(r, session.ChannelId)
+	if err != nil {
+		return llm.Options{}, err
+	}
+
+	instructions, err := app.models.Sessions.EffectiveInstructions(r.Context(), session, channel)
+	if err != nil {
+		return llm.Options{}, err
+	}
+
+	generation, err := app.models.Sessions.EffectiveGeneration(r.Context(), session, channel)
+	if err != nil {
+		return llm.Options{}, err
+	}
+
+	opts := llm.Options{Generation: generation.Merge(override)}
+	if instructions != nil {
+		opts.System = instructions.Text
+	}
+	if opts.Generation.Model == "" {
+		opts.Generation.Model = app.llm.DefaultModel()
+	}
+
+	return opts, nil
+}
+
+// anyModel in the -llm-models allowlist lets clients select any model.
+const anyModel = "any"
+
+// validateGeneration checks generation settings given by a client,
+// including that the model is one the server allows.
+func (app *application) validateGeneration(v *validator.Validator, cfg llm.GenerationConfig) {
+	data.ValidateGenerationConfig(v, cfg)
+
+	if cfg.Model != "" && !validator.In(anyModel, app.config.llm.models...) {
+		v.Check(validator.In(cfg.Model, app.config.llm.models...), "model", "must be one of the allowed models")
+	}
+}
+
+// getChatSession returns the cached chat for a session, rebuilding it from
+// the stored message history on a cache miss.
+func (app *application) getChatSession(ctx context.Context, session *data.Session) (*llm.ChatSession, error) {
+	sessionId := session.ID.Hex()
+
+	chatSession, found := app.sessionCache.Get(sessionId)
+	if found {
+		return chatSession, nil
+	}
+
+	previousMessages, err := app.models.Messages.GetAllMesssageById(ctx, session.Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[primitive.ObjectID]*data.Message, len(previousMessages))
+	for _, msg := range previousMessages {
+		byId[msg.ID] = msg
+	}
+
+	// Messages that cannot be replayed are skipped, but their place in the
+	// stored history is kept so that the compacted prefix still lines up.
+	chatSession = llm.NewChatSession(app.llm)
+	for _, id := range session.Messages {
+		msg, found := byId[id]
+		if !found || (msg.Data.Role != "user" && msg.Data.Role != "model") || len(msg.Data.Parts) == 0 {
+			chatSession.Skip()
+			continue
 		}
+		chatSession.AddMessage(msg.Data)
+	}
+
+	app.sessionCache.Set(sessionId, chatSession)
+
+	return chatSession, nil
+}
+
+// extendWriteDeadline gives a handler that makes up to calls model calls
+// long enough to respond, since the server's WriteTimeout only covers
+// ordinary requests.
+func (app *application) extendWriteDeadline(w http.ResponseWriter, calls int) error {
+	timeout := time.Duration(calls)*llm.RetryBound(app.config.llm.timeout) + 30*time.Second
+
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
 	}
-	newTree := &data.Tree{}
-	treeStructure := app.getTreeStructure(session, tree)
-	if session.IsRoot {
-		newTree = &data.Tree{
-			ChannelId:     session.ChannelId,
-			Root:          session.ID.Hex(),
-			TreeStructure: treeStructure,
+	return nil
+}
+
+// resolveAttachments returns history with every attachment reference
+// replaced by the attachment's content, ready to be sent to the model.
+// Messages without references are shared with history, which is left
+// untouched. An attachment that no longer exists is replaced by a note.
+func (app *application) resolveAttachments(ctx context.Context, history []llm.Data) ([]llm.Data, error) {
+	resolved := make([]llm.Data, len(history))
+	contents := map[string][]byte{}
+
+	for i, msg := range history {
+		resolved[i] = msg
+
+		hasFiles := false
+		for _, part := range msg.Parts {
+			hasFiles = hasFiles || part.File != nil
+		}
+		if !hasFiles {
+			continue
 		}
-	} else {
-		newTree = &data.Tree{
-			ChannelId:     session.ChannelId,
-			TreeStructure: treeStructure,
+
+		parts := make([]llm.Part, len(msg.Parts))
+		for j, part := range msg.Parts {
+			if part.File == nil {
+				parts[j] = part
+				continue
+			}
+
+			content, ok := contents[part.File.AttachmentId]
+			if !ok {
+				var err error
+				content, err = app.models.Attachments.Content(ctx, part.File.AttachmentId)
+				if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+					return nil, err
+				}
+				contents[part.File.AttachmentId] = content
+			}
+
+			if content == nil {
+				parts[j] = llm.TextPart(fmt.Sprintf("[attachment %q is no longer available]", part.File.Name))
+				continue
+			}
+			parts[j] = llm.Part{InlineData: &llm.InlineData{MimeType: part.File.MimeType, Data: content}}
 		}
+		resolved[i] = llm.Data{Role: msg.Role, Parts: parts}
+	}
+
+	return resolved, nil
+}
+
+// compactHistory returns the history to send to the model for a session.
+// Once the history outgrows the context window it is compacted with the
+// configured strategy. The summarize strategy stores its summary in the
+// session's context, so later turns only summarize what came after it. The
+// returned usage is that of any summary generated on the way, and the
+// budget leaves room for the system instructions in opts.
+func (app *application) compactHistory(r *http.Request, session *data.Session, chatSession *llm.ChatSession, opts llm.Options) ([]llm.Data, llm.Usage) {
+	cfg := app.config.compaction
+	messages := chatSession.Messages
+
+	if cfg.maxTokens <= 0 {
+		return messages, llm.Usage{}
+	}
+
+	// The system instructions take up part of the context window too.
+	if opts.System != "" {
+		system := []llm.Data{{Role: "system", Parts: []llm.Part{llm.TextPart(opts.System)}}}
+		cfg.maxTokens = max(cfg.maxTokens-llm.EstimateTokens(system), 1)
+	}
+
+	if llm.EstimateTokens(messages) <= cfg.maxTokens {
+		return messages, llm.Usage{}
+	}
+
+	switch cfg.strategy {
+	case llm.CompactWindow:
+		return llm.Window(messages, cfg.maxTokens), llm.Usage{}
+	case llm.CompactFirstLast:
+		return llm.FirstLast(messages, cfg.keepFirst, cfg.keepLast, cfg.maxTokens), llm.Usage{}
+	}
+
+	// The last message is the one being sent and is never summarized. The
+	// summary covers a prefix of the stored history, which may include
+	// messages that are not in the chat.
+	summary, from := session.Context, chatSession.Index(session.Compacted)
+	if from >= len(messages) {
+		summary, from = "", 0
+	}
+
+	fit := func(summary string, messages []llm.Data) []llm.Data {
+		budget := cfg.maxTokens - llm.EstimateTokens(llm.WithSummary(summary, nil))
+		return llm.WithSummary(summary, llm.Window(messages, budget))
+	}
+
+	history := llm.WithSummary(summary, messages[from:])
+	if llm.EstimateTokens(history) <= cfg.maxTokens {
+		return history, llm.Usage{}
+	}
+
+	cut := llm.SummaryCut(messages, from, max(cfg.keepLast, 1))
+	if cut == from {
+		return fit(summary, messages[from:]), llm.Usage{}
+	}
+
+	newSummary, usage, err := chatSession.Summarize(r.Context(), summary, messages[from:cut], opts)
+	if newSummary == "" {
+		app.logError(r, err)
+		return fit(summary, messages[from:]), usage
+	}
+
+	err = app.models.Sessions.UpdateContext(r.Context(), session, newSummary, chatSession.Stored(cut))
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		app.logError(r, err)
+	}
+
+	return fit(newSummary, messages[cut:]), usage
+}
+
+// summarizeSession brings the session's summary up to date with its
+// messages. Only the messages added since the last summary are sent to the
+// model, along with that summary, with the session's call options. It
+// returns the usage of the model call.
+func (app *application) summarizeSession(ctx context.Context, session *data.Session, opts llm.Options) (llm.Usage, error) {
+	summary, from := session.Summary, session.SummaryCount
+	if from > len(session.Messages) {
+		summary, from = "", 0
 	}
-	return newTree, nil
+	if from == len(session.Messages) {
+		return llm.Usage{}, nil
+	}
+
+	messages, err := app.models.Messages.GetAllMesssageById(ctx, session.Messages[from:])
+	if err != nil {
+		return llm.Usage{}, err
+	}
+
+	history := make([]llm.Data, 0, len(messages))
+	for _, msg := range messages {
+		history = append(history, msg.Data)
+	}
+
+	summary, usage, err := llm.NewChatSession(app.llm).GetChatSummary(ctx, summary, history, opts)
+	if summary == "" {
+		return usage, err
+	}
+
+	return usage, app.models.Sessions.UpdateSummary(ctx, session, summary, len(session.Messages))
 }
 
-func (app *application) getTreeStructure(session *data.Session, tree *data.Tree) map[string]interface{} {
-	if session.IsRoot {
-		treeStruct := map[string]interface{}{
-			"root":     session.ID.Hex(),
-			"children": []interface{}{},
+// refreshSummary updates the summary of a session that has one in the
+// background, once new messages have been stored.
+func (app *application) refreshSummary(r *http.Request, session *data.Session, opts llm.Options) {
+	if session.Summary == "" {
+		return
+	}
+
+	userID := app.contextGetUser(r).ID
+	requestID := app.contextGetRequestInfo(r).id
+	snapshot := *session
+
+	app.background(func() {
+		usage, err := app.summarizeSession(context.Background(), &snapshot, opts)
+		app.recordUsage(context.Background(), userID, usage)
+		if err != nil && !errors.Is(err, data.ErrEditConflict) {
+			app.logger.PrintError(err, map[string]string{
+				"request_id": requestID,
+				"session_id": snapshot.ID.Hex(),
+			})
 		}
-		return treeStruct
-	} else {
-		existingTree := tree.TreeStructure
-		parentId := session.ParentId
-
-		queue := list.New()
-		queue.PushBack(existingTree)
-
-		for queue.Len() > 0 {
-			node := queue.Remove(queue.Front()).(map[string]interface{})
-
-			if node["root"].(string) == parentId {
-				// Handle the children array safely with type checking
-				var children []interface{}
-
-				// Check what type the children field actually is
-				switch childrenVal := node["children"].(type) {
-				case []interface{}:
-					children = childrenVal
-				case primitive.A:
-					// Convert primitive.A to []interface{}
-					children = make([]interface{}, len(childrenVal))
-					copy(children, childrenVal)
-				default:
-					// Initialize a new array if it's neither type
-					children = []interface{}{}
-				}
+	})
+}
+
+// saveExchange stores the user's message and the model's reply and appends
+// both to the session in a single transaction. It returns the ID of the
+// stored reply, or ErrEditConflict when the session has changed since it was
+// read, in which case the reply was generated from stale history. The reply
+// records the generation settings it was generated with.
+func (app *application) saveExchange(ctx context.Context, session *data.Session, userMessage *data.Message, text string, generation llm.GenerationConfig) (string, error) {
+	aiMessage := &data.Message{
+		SessionId:  session.ID.Hex(),
+		Generation: &generation,
+	}
+	aiMessage.Data.Role = "model"
+	aiMessage.Data.Parts = []llm.Part{llm.TextPart(text)}
 
-				// Add the new node
-				children = append(children, map[string]interface{}{
-					"root":     session.ID.Hex(),
-					"children": []interface{}{},
-				})
+	var aiMessageId string
+	var updated data.Session
+	err := app.models.Transaction(ctx, func(ctx context.Context) error {
+		// Work on a copy so that a retried transaction starts from the
+		// version that was read.
+		updated = *session
 
-				node["children"] = children
-				return existingTree
+		userMessage.Sequence = len(updated.Messages) + 1
+		aiMessage.Sequence = len(updated.Messages) + 2
+
+		_, err := app.models.Messages.Insert(ctx, userMessage)
+		if err != nil {
+			return err
+		}
+
+		aiMessageId, err = app.models.Messages.Insert(ctx, aiMessage)
+		if err != nil {
+			return err
+		}
+
+		return app.models.Sessions.AppendMessages(ctx, &updated, []primitive.ObjectID{userMessage.ID, aiMessage.ID})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	*session = updated
+	return aiMessageId, nil
+}
+
+// insertSession stores a new session and links it into its channel and the
+// channel's tree in a single transaction, so a session never exists without
+// being linked. A concurrent change to the tree is retried.
+func (app *application) insertSession(ctx context.Context, session *data.Session) (string, error) {
+	var sessionId string
+	err := app.retryOnConflict(func() error {
+		return app.models.Transaction(ctx, func(ctx context.Context) error {
+			tree, err := app.models.Trees.GetByChannelId(ctx, session.ChannelId)
+			if err != nil {
+				return err
 			}
 
-			// Add all children to the queue - with safer type handling
-			if childrenVal, exists := node["children"]; exists {
-				var children []interface{}
-
-				switch typedChildren := childrenVal.(type) {
-				case []interface{}:
-					children = typedChildren
-				case primitive.A:
-					// Convert primitive.A to []interface{}
-					children = make([]interface{}, len(typedChildren))
-					copy(children, typedChildren)
-				}
+			sessionId, err = app.models.Sessions.Insert(ctx, session)
+			if err != nil {
+				return err
+			}
 
-				for _, child := range children {
-					if childMap, ok := child.(map[string]interface{}); ok {
-						queue.PushBack(childMap)
-					}
-				}
+			channel := &data.Channel{
+				Sessions: []primitive.ObjectID{session.ID},
+			}
+
+			err = app.models.Channel.Update(ctx, session.ChannelId, channel)
+			if err != nil {
+				return err
 			}
+
+			// The structure itself is recorded on the session through its
+			// parent_id and path; the tree only tracks its root and version.
+			if session.IsRoot {
+				tree.Root = sessionId
+			}
+
+			return app.models.Trees.Update(ctx, session.ChannelId, tree)
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return sessionId, nil
+}
+
+// deleteSession deletes a session as decided by mode, removes the deleted
+// sessions from their channel, records the change on the tree and removes
+// the messages no remaining session references. It returns the IDs of every
+// deleted session and must run in a transaction.
+func (app *application) deleteSession(ctx context.Context, id, mode string) ([]string, error) {
+	removed, err := app.models.Sessions.Delete(ctx, id, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	session := removed[0]
+
+	removedIds := make([]primitive.ObjectID, 0, len(removed))
+	messageIds := []primitive.ObjectID{}
+	for _, s := range removed {
+		removedIds = append(removedIds, s.ID)
+		messageIds = append(messageIds, s.Messages...)
+	}
+
+	err = app.models.Channel.RemoveSessions(ctx, session.ChannelId, removedIds)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Trees.RecordDeletion(ctx, session.ChannelId, session.IsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	unreferenced, err := app.models.Sessions.Unreferenced(ctx, messageIds)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Messages.DeleteMany(ctx, unreferenced)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(removedIds))
+	for _, removedId := range removedIds {
+		ids = append(ids, removedId.Hex())
+	}
+
+	return ids, nil
+}
+
+// retryOnConflict runs fn again when it fails with an edit conflict. fn must
+// re-read everything it modifies, so it is only used where repeating the
+// work is safe.
+func (app *application) retryOnConflict(fn func() error) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		err = fn()
+		if !errors.Is(err, data.ErrEditConflict) {
+			return err
 		}
+	}
+	return err
+}
 
-		return existingTree
+// setRateLimitHeaders reports the state of a rate limit using the
+// RateLimit-* header fields, plus Retry-After when the request was refused.
+func (app *application) setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
 	}
 }
-func (app *application) cleanupInactiveSessions() {
-	app.sessionMutex.Lock()
-	defer app.sessionMutex.Unlock()
 
-	if len(app.activeSessions) > 100 {
-		count := 0
-		for key := range app.activeSessions {
-			delete(app.activeSessions, key)
-			count++
-			if count >= len(app.activeSessions)/2 {
-				break
-			}
+// checkTokenBudget refuses the request when the user has used up their
+// daily LLM token budget. It reports whether the request may continue.
+func (app *application) checkTokenBudget(w http.ResponseWriter, r *http.Request) bool {
+	if app.config.limiter.dailyTokens <= 0 {
+		return true
+	}
+
+	user := app.contextGetUser(r)
+	now := time.Now()
+
+	used, err := app.models.Usage.GetTokens(r.Context(), user.ID, data.UsageDay(now))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if used < app.config.limiter.dailyTokens {
+		return true
+	}
+
+	// The budget resets at midnight UTC.
+	midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(midnight.Sub(now))))
+	app.tokenBudgetExceededResponse(w, r)
+	return false
+}
+
+// recordUsage adds the tokens of a model call to the user's daily usage.
+func (app *application) recordUsage(ctx context.Context, userID primitive.ObjectID, usage llm.Usage) {
+	if usage.Total() == 0 {
+		return
+	}
+
+	_, err := app.models.Usage.AddTokens(ctx, userID, data.UsageDay(time.Now()), usage.Total())
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": userID.Hex()})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// trustedOrigin reports whether origin matches one of the trusted origins.
+// A "*." host prefix matches any subdomain but not the domain itself.
+func (app *application) trustedOrigin(origin string) bool {
+	for _, trusted := range app.config.cors.trustedOrigins {
+		if trusted == "*" || origin == trusted {
+			return true
 		}
-		app.logger.PrintInfo("cleaned up sessions", map[string]string{
-			"removed":   fmt.Sprintf("%d", count),
-			"remaining": fmt.Sprintf("%d", len(app.activeSessions)),
-		})
+
+		scheme, host, found := strings.Cut(trusted, "://*.")
+		if !found {
+			continue
+		}
+
+		suffix, ok := strings.CutPrefix(origin, scheme+"://")
+		if ok && strings.HasSuffix(suffix, "."+host) && !strings.ContainsAny(suffix, "/@") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validRequestID accepts IDs of up to 128 letters, digits, '-', '_' and '.',
+// so that client supplied IDs cannot inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// background runs fn in a goroutine that the server waits for on shutdown.
+// A panic in fn is logged instead of crashing the process.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
 }
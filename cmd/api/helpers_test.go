@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func TestTrustedOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		origin  string
+		want    bool
+	}{
+		{name: "exact", trusted: []string{"https://example.com"}, origin: "https://example.com", want: true},
+		{name: "other scheme", trusted: []string{"https://example.com"}, origin: "http://example.com", want: false},
+		{name: "any", trusted: []string{"*"}, origin: "https://anything.test", want: true},
+		{name: "none", trusted: nil, origin: "https://example.com", want: false},
+		{name: "subdomain", trusted: []string{"https://*.example.org"}, origin: "https://api.example.org", want: true},
+		{name: "nested subdomain", trusted: []string{"https://*.example.org"}, origin: "https://a.b.example.org", want: true},
+		{name: "bare domain", trusted: []string{"https://*.example.org"}, origin: "https://example.org", want: false},
+		{name: "suffix without a dot", trusted: []string{"https://*.example.org"}, origin: "https://evilexample.org", want: false},
+		{name: "wildcard scheme mismatch", trusted: []string{"https://*.example.org"}, origin: "http://api.example.org", want: false},
+		{name: "domain as a prefix", trusted: []string{"https://*.example.org"}, origin: "https://api.example.org.evil.test", want: false},
+		{name: "userinfo", trusted: []string{"https://*.example.org"}, origin: "https://evil.test@api.example.org", want: false},
+		{name: "path", trusted: []string{"https://*.example.org"}, origin: "https://evil.test/.example.org", want: false},
+		{name: "second entry", trusted: []string{"https://example.com", "https://*.example.org"}, origin: "https://api.example.org", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.cors.trustedOrigins = tt.trusted
+
+			if got := app.trustedOrigin(tt.origin); got != tt.want {
+				t.Errorf("trustedOrigin(%q): got %v; want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGenerationModel(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		model   string
+		want    bool
+	}{
+		{name: "unset", allowed: []string{"gemini-2.0-flash"}, model: "", want: true},
+		{name: "allowed", allowed: []string{"gemini-2.0-flash", "gemini-2.5-pro"}, model: "gemini-2.5-pro", want: true},
+		{name: "not allowed", allowed: []string{"gemini-2.0-flash"}, model: "gemini-2.5-pro", want: false},
+		{name: "any", allowed: []string{anyModel}, model: "gemini-2.5-pro", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.llm.models = tt.allowed
+
+			v := validator.New()
+			app.validateGeneration(v, llm.GenerationConfig{Model: tt.model})
+
+			if v.Valid() != tt.want {
+				t.Errorf("model %q: got valid %v; want %v (errors %v)", tt.model, v.Valid(), tt.want, v.Errors)
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +18,10 @@ import (
 	"misc.sahilsasane.net/internal/data"
 	"misc.sahilsasane.net/internal/jsonlog"
 	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/mailer"
+	"misc.sahilsasane.net/internal/metrics"
+	"misc.sahilsasane.net/internal/sessioncache"
+	"misc.sahilsasane.net/internal/validator"
 )
 
 var (
@@ -26,36 +33,77 @@ type config struct {
 	env  string
 	port int
 	db   struct {
-		uri         string
-		database    string
-		maxPoolSize uint64
-		minPoolSize uint64
-		maxIdleTime string
-	}
-	// limiter struct {
-	// 	rps     float64
-	// 	burst   int
-	// 	enabled bool
-	// }
-	// cors struct {
-	// 	trustedOrigins []string
-	// }
+		uri          string
+		database     string
+		maxPoolSize  uint64
+		minPoolSize  uint64
+		maxIdleTime  string
+		transactions bool
+		timeout      time.Duration
+	}
+	limiter struct {
+		rps         float64
+		burst       int
+		userRPS     float64
+		userBurst   int
+		enabled     bool
+		dailyTokens int
+	}
+	metrics struct {
+		addr string
+	}
+	cors struct {
+		trustedOrigins   []string
+		allowCredentials bool
+		exposedHeaders   []string
+	}
 	jwt struct {
-		secret string
+		secret     string
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	llm struct {
+		provider string
+		model    string
+		models   []string
+		baseURL  string
+		timeout  time.Duration
+	}
+	compaction struct {
+		strategy  string
+		maxTokens int
+		keepFirst int
+		keepLast  int
+	}
+	attachments struct {
+		maxSize int64
+	}
+	sessionCache struct {
+		size int
+		ttl  time.Duration
 	}
 	apiKey struct {
-		gemini string
+		gemini    string
+		openai    string
+		anthropic string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
 	}
 }
 
 type application struct {
-	config         config
-	logger         *jsonlog.Logger
-	models         data.Models
-	wg             sync.WaitGroup
-	activeSessions map[string]*llm.ChatSession
-	sessionMutex   sync.RWMutex
-	geminiClient   *llm.GeminiClient
+	config       config
+	logger       *jsonlog.Logger
+	models       data.Models
+	mailer       mailer.Mailer
+	wg           sync.WaitGroup
+	sessionCache *sessioncache.Cache
+	llm          llm.Provider
 }
 
 func main() {
@@ -65,12 +113,59 @@ func main() {
 	flag.StringVar(&cfg.env, "env", "development", "Environment")
 	flag.StringVar(&cfg.db.uri, "mongo-uri", "", "Mongo Uri")
 	flag.StringVar(&cfg.db.database, "db-name", "url", "Database name")
+	flag.StringVar(&cfg.llm.provider, "llm-provider", llm.ProviderGemini, "LLM provider (gemini|openai|anthropic)")
+	flag.StringVar(&cfg.llm.model, "llm-model", "", "LLM model name (defaults to the provider's default model)")
+	flag.Func("llm-models", "Models that sessions may select (space separated, \"any\" allows any model; defaults to the configured model)", func(val string) error {
+		cfg.llm.models = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.llm.baseURL, "llm-base-url", "", "LLM API base URL (e.g. a local OpenAI-compatible server)")
+	flag.DurationVar(&cfg.llm.timeout, "llm-timeout", 2*time.Minute, "Timeout for a single LLM call, including streaming the whole reply")
+	flag.StringVar(&cfg.compaction.strategy, "llm-compaction", llm.CompactSummarize, "History compaction strategy (window|summarize|first-last)")
+	flag.IntVar(&cfg.compaction.maxTokens, "llm-context-tokens", 100000, "Estimated prompt tokens above which the history is compacted (0 disables compaction)")
+	flag.IntVar(&cfg.compaction.keepFirst, "llm-keep-first", 2, "Messages kept from the start of the history by the first-last strategy")
+	flag.IntVar(&cfg.compaction.keepLast, "llm-keep-last", 10, "Recent messages kept verbatim by the summarize and first-last strategies")
+	flag.Int64Var(&cfg.attachments.maxSize, "attachments-max-size", 20<<20, "Maximum size of an uploaded attachment in bytes")
+	flag.IntVar(&cfg.sessionCache.size, "session-cache-size", 1000, "Maximum number of chat sessions kept in memory (0 for no limit)")
+	flag.DurationVar(&cfg.sessionCache.ttl, "session-cache-ttl", time.Hour, "Drop cached chat sessions idle for longer than this (0 to keep them)")
 	flag.StringVar(&cfg.apiKey.gemini, "gemini-api-key", "", "Gemini Api key")
+	flag.StringVar(&cfg.apiKey.openai, "openai-api-key", "", "OpenAI Api key")
+	flag.StringVar(&cfg.apiKey.anthropic, "anthropic-api-key", "", "Anthropic Api key")
 	flag.Uint64Var(&cfg.db.maxPoolSize, "db-max-pool-size", 100, "Max pool size")
 	flag.Uint64Var(&cfg.db.minPoolSize, "db-min-pool-size", 10, "Min pool size")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "Max idle time")
+	flag.DurationVar(&cfg.db.timeout, "db-timeout", 3*time.Second, "Timeout for a single database operation")
+	flag.BoolVar(&cfg.db.transactions, "db-transactions", false, "Use multi-document transactions (requires a replica set)")
+
+	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second per IP")
+	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst per IP")
+	flag.Float64Var(&cfg.limiter.userRPS, "limiter-user-rps", 2, "Rate limiter maximum requests per second per user")
+	flag.IntVar(&cfg.limiter.userBurst, "limiter-user-burst", 4, "Rate limiter maximum burst per user")
+	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.IntVar(&cfg.limiter.dailyTokens, "limiter-daily-tokens", 200000, "Maximum LLM tokens per user per day (0 disables the budget)")
+
+	flag.StringVar(&cfg.metrics.addr, "metrics-addr", "", "Metrics listen address, e.g. localhost:9090 (disabled when empty)")
+
+	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated, e.g. https://*.example.com)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+	flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests")
+	cfg.cors.exposedHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"}
+	flag.Func("cors-exposed-headers", "Response headers exposed to CORS requests (space separated)", func(val string) error {
+		cfg.cors.exposedHeaders = strings.Fields(val)
+		return nil
+	})
 
 	flag.StringVar(&cfg.jwt.secret, "jwt-secret", "", "JWT secret")
+	flag.DurationVar(&cfg.jwt.accessTTL, "jwt-access-ttl", 15*time.Minute, "Access token lifetime")
+	flag.DurationVar(&cfg.jwt.refreshTTL, "jwt-refresh-ttl", 7*24*time.Hour, "Refresh token lifetime")
+
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 1025, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username (leave empty for servers without authentication)")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Cautious Tree <no-reply@misc.sahilsasane.net>", "SMTP sender")
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -82,8 +177,22 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(cfg.cors.trustedOrigins) == 0 {
+		cfg.cors.trustedOrigins = strings.Fields(os.Getenv("CORS_TRUSTED_ORIGINS"))
+	}
+
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	// A wildcard origin with credentials would let any site make
+	// authenticated requests on behalf of a signed-in user.
+	if cfg.cors.allowCredentials && slices.Contains(cfg.cors.trustedOrigins, "*") {
+		logger.PrintFatal(errors.New("cors-allow-credentials cannot be used with a \"*\" trusted origin"), nil)
+	}
+
+	if !validator.In(cfg.compaction.strategy, llm.CompactWindow, llm.CompactSummarize, llm.CompactFirstLast) {
+		logger.PrintFatal(fmt.Errorf("invalid llm compaction strategy %q", cfg.compaction.strategy), nil)
+	}
+
 	db, err := OpenDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -97,16 +206,40 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	provider, err := newLLMProvider(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if len(cfg.llm.models) == 0 {
+		cfg.llm.models = []string{provider.DefaultModel()}
+	}
+
 	expvar.NewString("version").Set(version)
 
 	app := &application{
-		config:         cfg,
-		logger:         logger,
-		models:         data.NewModels(db, cfg.db.database),
-		activeSessions: make(map[string]*llm.ChatSession),
-		geminiClient:   llm.NewGeminiClient(cfg.apiKey.gemini),
+		config:       cfg,
+		logger:       logger,
+		models:       data.NewModels(db, cfg.db.database, cfg.db.transactions, cfg.db.timeout),
+		mailer:       mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		sessionCache: sessioncache.New(cfg.sessionCache.size, cfg.sessionCache.ttl),
+		llm:          provider,
+	}
+
+	migrated, err := app.models.MigrateTreePaths(context.Background())
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if migrated > 0 {
+		logger.PrintInfo("migrated sessions to tree paths", map[string]string{
+			"sessions": fmt.Sprintf("%d", migrated),
+		})
 	}
 
+	metrics.NewGaugeFunc("chat_sessions_cached", "Chat sessions held in the in-memory cache.", func() float64 {
+		return float64(app.sessionCache.Len())
+	})
+
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
@@ -140,3 +273,23 @@ func OpenDB(cfg config) (*mongo.Client, error) {
 
 	return client, nil
 }
+
+func newLLMProvider(cfg config) (llm.Provider, error) {
+	llmConfig := llm.Config{
+		Provider: cfg.llm.provider,
+		Model:    cfg.llm.model,
+		BaseURL:  cfg.llm.baseURL,
+		Timeout:  cfg.llm.timeout,
+	}
+
+	switch cfg.llm.provider {
+	case llm.ProviderGemini:
+		llmConfig.APIKey = cfg.apiKey.gemini
+	case llm.ProviderOpenAI:
+		llmConfig.APIKey = cfg.apiKey.openai
+	case llm.ProviderAnthropic:
+		llmConfig.APIKey = cfg.apiKey.anthropic
+	}
+
+	return llm.NewProvider(llmConfig)
+}
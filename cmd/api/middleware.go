@@ -1,170 +1,252 @@
 package main
 
-// import (
-// 	"errors"
-// 	"expvar"
-// 	"fmt"
-// 	"net/http"
-// 	"strconv"
-// 	"strings"
-// 	"sync"
-// 	"time"
-
-// 	"github.com/felixge/httpsnoop"
-// 	"github.com/pascaldekloe/jwt"
-// 	"github.com/tomasen/realip"
-// 	"go.mongodb.org/mongo-driver/bson/primitive"
-// 	"golang.org/x/time/rate"
-// 	"misc.sahilsasane.net/internal/data"
-// )
-
-// func (app *application) recoverPanic(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		defer func() {
-// 			if err := recover(); err != nil {
-// 				w.Header().Set("Connection", "close")
-// 				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
-// 			}
-// 		}()
-// 	})
-// }
-// func (app *application) rateLimit(next http.Handler) http.Handler {
-// 	type client struct {
-// 		limiter  *rate.Limiter
-// 		lastSeen time.Time
-// 	}
-// 	var (
-// 		mu      sync.Mutex
-// 		clients = make(map[string]*client)
-// 	)
-
-// 	go func() {
-// 		for {
-// 			time.Sleep(time.Minute)
-// 			mu.Lock()
-// 			for ip, client := range clients {
-// 				if time.Since(client.lastSeen) > 3*time.Minute {
-// 					delete(clients, ip)
-// 				}
-// 			}
-// 			mu.Unlock()
-// 		}
-// 	}()
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-// 		if app.config.limiter.enabled {
-// 			ip := realip.FromRequest(r)
-// 			mu.Lock()
-// 			if _, found := clients[ip]; !found {
-
-// 				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-// 			}
-// 			clients[ip].lastSeen = time.Now()
-// 			if !clients[ip].limiter.Allow() {
-// 				mu.Unlock()
-// 				app.rateLimitExceededResponse(w, r)
-// 				return
-// 			}
-// 			mu.Unlock()
-// 		}
-// 		next.ServeHTTP(w, r)
-// 	})
-// }
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-// func (app *application) authenticate(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.Header().Add("Vary", "Authorization")
-// 		authorizationHeader := r.Header.Get("Authorization")
-
-// 		if authorizationHeader == "" {
-// 			r = app.contextSetUser(r, data.AnonymousUser)
-// 			next.ServeHTTP(w, r)
-// 			return
-// 		}
-
-// 		headerParts := strings.Split(authorizationHeader, " ")
-// 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-// 			app.invalidCredentailsReponse(w, r)
-// 			return
-// 		}
-
-// 		token := headerParts[1]
-
-// 		claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
-// 		if err != nil {
-// 			app.invalidAuthenticationTokenResponse(w, r)
-// 			return
-// 		}
-
-// 		if !claims.Valid(time.Now()) {
-// 			app.invalidAuthenticationTokenResponse(w, r)
-// 			return
-// 		}
-
-// 		if claims.Issuer != "misc.sahilsasane.net" {
-// 			app.invalidAuthenticationTokenResponse(w, r)
-// 			return
-// 		}
-
-// 		if !claims.AcceptAudience("misc.sahilsasane.net") {
-// 			app.invalidAuthenticationTokenResponse(w, r)
-// 			return
-// 		}
-
-// 		userID := claims.Subject
-// 		fmt.Print("\n", userID, "\n")
-// 		fmt.Print("\n", claims, "\n")
-// 		if userID == "" {
-// 			app.invalidAuthenticationTokenResponse(w, r)
-// 			return
-// 		}
-
-// 		objId, err := primitive.ObjectIDFromHex(userID)
-// 		if err != nil {
-// 			app.serverErrorResponse(w, r, err)
-// 			return
-// 		}
-// 		user, err := app.models.Users.Get(objId)
-// 		if err != nil {
-// 			switch {
-// 			case errors.Is(err, data.ErrRecordNotFound):
-// 				app.invalidAuthenticationTokenResponse(w, r)
-// 			default:
-// 				app.serverErrorResponse(w, r, err)
-// 			}
-// 			return
-// 		}
-
-// 		r = app.contextSetUser(r, user)
-// 		next.ServeHTTP(w, r)
-// 	})
-// }
+	"github.com/pascaldekloe/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"misc.sahilsasane.net/internal/data"
+	"misc.sahilsasane.net/internal/metrics"
+	"misc.sahilsasane.net/internal/ratelimit"
+)
 
-// func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
-// 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		user := app.contextGetUser(r)
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		authorizationHeader := r.Header.Get("Authorization")
 
-// 		if !user.Activated {
-// 			app.inactiveAccountResponse(w, r)
-// 			return
-// 		}
-// 		next.ServeHTTP(w, r)
-// 	})
-// 	return app.requireAuthenticatedUser(fn)
-// }
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
 
-// func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		user := app.contextGetUser(r)
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
 
-// 		if user.IsAnonymous() {
-// 			app.authenticationRequiredResponse(w, r)
-// 			return
-// 		}
+		token := headerParts[1]
 
-// 		next.ServeHTTP(w, r)
-// 	})
-// }
+		claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secret))
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		if claims.Expires == nil || claims.ID == "" || !claims.Valid(time.Now()) {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		if claims.Issuer != "misc.sahilsasane.net" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		if !claims.AcceptAudience("misc.sahilsasane.net") {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		objId, err := primitive.ObjectIDFromHex(claims.Subject)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		revoked, err := app.models.Tokens.IsRevoked(r.Context(), claims.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if revoked {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(r.Context(), objId)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.contextGetRequestInfo(r).userID = user.ID.Hex()
+
+		r = app.contextSetUser(r, user)
+		r = app.contextSetClaims(r, claims)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw, ok := w.(*responseWriter)
+		if !ok {
+			rw = newResponseWriter(w)
+		}
+
+		defer func() {
+			if err := recover(); err != nil {
+				// Once the response has started, an error response would be
+				// written into the middle of it, so abort the connection and
+				// let the client see a truncated reply instead.
+				if rw.headerWritten {
+					app.logError(r, fmt.Errorf("%s", err))
+					panic(http.ErrAbortHandler)
+				}
+
+				rw.Header().Set("Connection", "close")
+				app.serverErrorResponse(rw, r, fmt.Errorf("%s", err))
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// requestID gives every request an ID, reusing a well-formed X-Request-ID
+// sent by the client or a proxy, and returns it in the X-Request-ID header.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestInfo(r, &requestInfo{id: id})
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequest writes one access log line per request once the response has
+// been written.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rw := newResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		info := app.contextGetRequestInfo(r)
+
+		app.logger.PrintInfo("request", map[string]string{
+			"request_id":  info.id,
+			"method":      r.Method,
+			"route":       info.route,
+			"path":        r.URL.Path,
+			"status":      strconv.Itoa(rw.statusCode),
+			"bytes":       strconv.Itoa(rw.bytesWritten),
+			"duration_ms": strconv.FormatFloat(float64(time.Since(start).Microseconds())/1000, 'f', 3, 64),
+			"user_id":     info.userID,
+			"remote_addr": r.RemoteAddr,
+		})
+	})
+}
+
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	limiter := ratelimit.New(app.config.limiter.rps, app.config.limiter.burst)
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			limiter.Cleanup(3 * time.Minute)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.limiter.enabled {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			result := limiter.Allow(ip)
+			app.setRateLimitHeaders(w, result)
+			if !result.Allowed {
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitUser limits authenticated users regardless of the address they
+// connect from. It must run after authenticate.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	limiter := ratelimit.New(app.config.limiter.userRPS, app.config.limiter.userBurst)
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			limiter.Cleanup(3 * time.Minute)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if app.config.limiter.enabled && !user.IsAnonymous() {
+			result := limiter.Allow(user.ID.Hex())
+			app.setRateLimitHeaders(w, result)
+			if !result.Allowed {
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
 // func (app *application) requirePermission(next http.HandlerFunc) http.HandlerFunc {
 // 	fn := func(w http.ResponseWriter, r *http.Request) {
@@ -174,41 +256,120 @@ package main
 // 	return app.requireActivatedUser(fn)
 // }
 
-// func (app *application) enableCORS(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.Header().Add("Vary", "Origin")
-// 		w.Header().Add("Vary", "Access-Control-Request-Method")
-
-// 		origin := r.Header.Get("Origin")
-// 		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-// 			for i := range app.config.cors.trustedOrigins {
-// 				if origin == app.config.cors.trustedOrigins[i] {
-// 					w.Header().Set("Access-Control-Allow-Origin", origin)
-// 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-// 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-// 						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-// 						w.WriteHeader(http.StatusOK)
-// 						return
-// 					}
-// 				}
-// 			}
-// 		}
-// 		next.ServeHTTP(w, r)
-// 	})
-// }
+// enableCORS allows browsers on trusted origins to call the API. A trusted
+// origin may use a wildcard for its subdomains, e.g. https://*.example.com.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
 
-// func (app *application) metrics(next http.Handler) http.Handler {
-// 	totalRequestsReceived := expvar.NewInt("total_requests_received")
-// 	totalResponsesSent := expvar.NewInt("total_responses_sent")
-// 	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-// 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
-
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		totalRequestsReceived.Add(1)
-// 		metrics := httpsnoop.CaptureMetrics(next, w, r)
-// 		totalResponsesSent.Add(1)
-// 		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
-// 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
-// 	})
-// }
+		origin := r.Header.Get("Origin")
+		if origin != "" && app.trustedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			if app.config.cors.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+				w.Header().Set("Access-Control-Max-Age", "600")
+
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			if len(app.config.cors.exposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(app.config.cors.exposedHeaders, ", "))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"http_requests_total",
+		"HTTP requests by method, route and status.",
+		"method", "route", "status",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"http_request_duration_seconds",
+		"HTTP request latency by method, route and status.",
+		metrics.DefBuckets,
+		"method", "route", "status",
+	)
+)
+
+// metrics records the count and latency of every request by method, route
+// pattern and status.
+func (app *application) metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mw := newResponseWriter(w)
+		next.ServeHTTP(mw, r)
+
+		route := app.contextGetRequestInfo(r).route
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(mw.statusCode)
+
+		requestsTotal.Inc(r.Method, route, status)
+		requestDuration.Observe(time.Since(start).Seconds(), r.Method, route, status)
+	})
+}
+
+// route records the pattern a request was routed to. httprouter does not
+// expose it, so every route is registered through this wrapper.
+func (app *application) route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app.contextGetRequestInfo(r).route = pattern
+		next.ServeHTTP(w, r)
+	}
+}
+
+// responseWriter captures the status code and size of a response.
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// streaming responses rely on.
+type responseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+	bytesWritten  int
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{
+		wrapped:    w,
+		statusCode: http.StatusOK,
+	}
+}
+
+func (mw *responseWriter) Header() http.Header {
+	return mw.wrapped.Header()
+}
+
+func (mw *responseWriter) WriteHeader(statusCode int) {
+	mw.wrapped.WriteHeader(statusCode)
+
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+}
+
+func (mw *responseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+
+	n, err := mw.wrapped.Write(b)
+	mw.bytesWritten += n
+	return n, err
+}
+
+func (mw *responseWriter) Unwrap() http.ResponseWriter {
+	return mw.wrapped
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"misc.sahilsasane.net/internal/jsonlog"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelInfo)}
+
+	t.Run("before the response", func(t *testing.T) {
+		handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+		}
+		if got := rr.Header().Get("Connection"); got != "close" {
+			t.Errorf("got Connection %q; want %q", got, "close")
+		}
+	})
+
+	t.Run("after the response started", func(t *testing.T) {
+		handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "data: partial\n\n")
+			panic("boom")
+		}))
+
+		rr := httptest.NewRecorder()
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("got panic %v; want %v", err, http.ErrAbortHandler)
+			}
+			if got := rr.Body.String(); got != "data: partial\n\n" {
+				t.Errorf("got body %q; want only the partial response", got)
+			}
+		}()
+
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
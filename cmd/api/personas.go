@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"misc.sahilsasane.net/internal/data"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func (app *application) listPersonasHandler(w http.ResponseWriter, r *http.Request) {
+	personas, err := app.models.Personas.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"personas": personas}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPersonaHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string `json:"name"`
+		Instructions string `json:"instructions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	persona := &data.Persona{
+		UserId:       app.contextGetUser(r).ID,
+		Name:         input.Name,
+		Instructions: input.Instructions,
+	}
+
+	v := validator.New()
+
+	if data.ValidatePersona(v, persona); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Personas.Insert(r.Context(), persona)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePersona):
+			v.AddError("name", "a persona with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"persona": persona}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showPersonaHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	persona, err := app.models.Personas.GetForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"persona": persona}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updatePersonaHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	persona, err := app.models.Personas.GetForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name         *string `json:"name"`
+		Instructions *string `json:"instructions"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		persona.Name = *input.Name
+	}
+	if input.Instructions != nil {
+		persona.Instructions = *input.Instructions
+	}
+
+	v := validator.New()
+
+	if data.ValidatePersona(v, persona); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Personas.Update(r.Context(), persona)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePersona):
+			v.AddError("name", "a persona with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"persona": persona}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deletePersonaHandler removes a persona. Channels and sessions it was
+// applied to keep their copy of its instructions.
+func (app *application) deletePersonaHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	err := app.models.Personas.DeleteForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "persona successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// instructionsText returns the text of new instructions, given either
+// directly or by applying one of the user's personas. Problems with the
+// input are added to v.
+func (app *application) instructionsText(r *http.Request, v *validator.Validator, text *string, personaId string) (string, error) {
+	v.Check(text != nil || personaId != "", "text", "must be provided unless a persona_id is given")
+	v.Check(text == nil || personaId == "", "persona_id", "must not be given together with text")
+	if !v.Valid() {
+		return "", nil
+	}
+
+	if personaId == "" {
+		data.ValidateInstructions(v, *text)
+		return *text, nil
+	}
+
+	persona, err := app.models.Personas.GetForUser(r.Context(), personaId, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("persona_id", "must refer to one of your personas")
+			return "", nil
+		default:
+			return "", err
+		}
+	}
+
+	return persona.Instructions, nil
+}
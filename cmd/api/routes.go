@@ -12,27 +12,65 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/health", app.healthcheckHandler)
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		router.HandlerFunc(method, pattern, app.route(pattern, handler))
+	}
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	handle(http.MethodGet, "/v1/health", app.healthcheckHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/activations", app.createActivationTokenHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handle(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/channels/:id", app.getChannelHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/channels/:id/sessions", app.getAllChannelSessionsHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/channels/", app.createChannelHandler)
+	handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/activations", app.createActivationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/logout", app.requireAuthenticatedUser(app.logoutHandler))
+	handle(http.MethodPost, "/v1/tokens/revoke-all", app.requireAuthenticatedUser(app.revokeAllTokensHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/sessions/", app.createSessionHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/sessions/:id", app.getSessionHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/sessions/copy", app.copySessionHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/sessions/:id", app.appendContextHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/sessions/:id", app.deleteSessionHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/sessions/:id/messages", app.getAllSessionMessagesHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/sessions/message", app.sendSessionMessageHandler)
+	handle(http.MethodGet, "/v1/channels/:id", app.requireActivatedUser(app.getChannelHandler))
+	handle(http.MethodGet, "/v1/channels/:id/sessions", app.requireActivatedUser(app.getAllChannelSessionsHandler))
+	handle(http.MethodGet, "/v1/channels/:id/tree", app.requireActivatedUser(app.getChannelTreeHandler))
+	handle(http.MethodPut, "/v1/channels/:id/instructions", app.requireActivatedUser(app.updateChannelInstructionsHandler))
+	handle(http.MethodPut, "/v1/channels/:id/generation", app.requireActivatedUser(app.updateChannelGenerationHandler))
+	handle(http.MethodPost, "/v1/channels/", app.requireActivatedUser(app.createChannelHandler))
 
-	return router
+	handle(http.MethodPost, "/v1/sessions/", app.requireActivatedUser(app.createSessionHandler))
+	handle(http.MethodGet, "/v1/sessions/:id", app.requireActivatedUser(app.getSessionHandler))
+	handle(http.MethodPut, "/v1/sessions/:id", app.requireActivatedUser(app.appendContextHandler))
+	handle(http.MethodDelete, "/v1/sessions/:id", app.requireActivatedUser(app.deleteSessionHandler))
+	handle(http.MethodGet, "/v1/sessions/:id/messages", app.requireActivatedUser(app.getAllSessionMessagesHandler))
+	handle(http.MethodGet, "/v1/sessions/:id/instructions", app.requireActivatedUser(app.getSessionInstructionsHandler))
+	handle(http.MethodPut, "/v1/sessions/:id/instructions", app.requireActivatedUser(app.updateSessionInstructionsHandler))
+	handle(http.MethodGet, "/v1/sessions/:id/generation", app.requireActivatedUser(app.getSessionGenerationHandler))
+	handle(http.MethodPut, "/v1/sessions/:id/generation", app.requireActivatedUser(app.updateSessionGenerationHandler))
+	handle(http.MethodPost, "/v1/sessions/:id/summary", app.requireActivatedUser(app.summarizeSessionHandler))
+
+	// httprouter cannot register static segments next to a wildcard, so the
+	// POST routes that sit beside /v1/sessions/:id/summary are dispatched
+	// from the :id wildcard.
+	sessionActions := map[string]http.HandlerFunc{
+		"copy":    app.route("/v1/sessions/copy", app.requireActivatedUser(app.copySessionHandler)),
+		"message": app.route("/v1/sessions/message", app.requireActivatedUser(app.sendSessionMessageHandler)),
+	}
+	router.HandlerFunc(http.MethodPost, "/v1/sessions/:id", func(w http.ResponseWriter, r *http.Request) {
+		handler, found := sessionActions[app.readIDparam(r)]
+		if !found {
+			app.notFoundResponse(w, r)
+			return
+		}
+		handler(w, r)
+	})
+
+	handle(http.MethodGet, "/v1/personas", app.requireActivatedUser(app.listPersonasHandler))
+	handle(http.MethodPost, "/v1/personas", app.requireActivatedUser(app.createPersonaHandler))
+	handle(http.MethodGet, "/v1/personas/:id", app.requireActivatedUser(app.showPersonaHandler))
+	handle(http.MethodPatch, "/v1/personas/:id", app.requireActivatedUser(app.updatePersonaHandler))
+	handle(http.MethodDelete, "/v1/personas/:id", app.requireActivatedUser(app.deletePersonaHandler))
+
+	handle(http.MethodPost, "/v1/attachments", app.requireActivatedUser(app.uploadAttachmentHandler))
+	handle(http.MethodGet, "/v1/attachments/:id", app.requireActivatedUser(app.showAttachmentHandler))
+
+	return app.requestID(app.logRequest(app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.rateLimitUser(router))))))))
 }
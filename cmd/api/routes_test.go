@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"misc.sahilsasane.net/internal/jsonlog"
+)
+
+func TestRoutes(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelInfo)}
+
+	// Metrics are registered once per process, so building the router again
+	// must not register them a second time.
+	app.routes()
+	handler := app.routes()
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: http.MethodGet, path: "/metrics", want: http.StatusNotFound},
+		{method: http.MethodPost, path: "/v1/sessions/copy", want: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/v1/sessions/message", want: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/v1/sessions/64b7f0c2a1e4d3b2c1a09f8e/summary", want: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/v1/sessions/64b7f0c2a1e4d3b2c1a09f8e/generation", want: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/v1/sessions/64b7f0c2a1e4d3b2c1a09f8e", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: got status %d; want %d", tt.method, tt.path, rr.Code, tt.want)
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"misc.sahilsasane.net/internal/metrics"
 )
 
 func (app *application) serve() error {
@@ -20,6 +22,30 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Metrics are served on their own listener so they can be kept off the
+	// public interface.
+	var metricsSrv *http.Server
+	if app.config.metrics.addr != "" {
+		metricsSrv = &http.Server{
+			Addr:         app.config.metrics.addr,
+			Handler:      metrics.Handler(),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+
+		go func() {
+			app.logger.PrintInfo("starting metrics server", map[string]string{
+				"addr": metricsSrv.Addr,
+			})
+
+			err := metricsSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, nil)
+			}
+		}()
+	}
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -35,6 +61,10 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
@@ -48,12 +78,17 @@ func (app *application) serve() error {
 		shutdownError <- nil
 	}()
 	go func() {
-		ticker := time.NewTicker(30 * time.Minute)
+		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			// Clean up sessions that haven't been used in the last hour
-			app.cleanupInactiveSessions()
+			removed := app.sessionCache.Cleanup()
+			if removed > 0 {
+				app.logger.PrintInfo("cleaned up sessions", map[string]string{
+					"removed":   fmt.Sprintf("%d", removed),
+					"remaining": fmt.Sprintf("%d", app.sessionCache.Len()),
+				})
+			}
 		}
 	}()
 
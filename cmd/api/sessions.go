@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"misc.sahilsasane.net/internal/data"
@@ -31,22 +33,53 @@ func (app *application) createSessionHandler(w http.ResponseWriter, r *http.Requ
 	}
 	v := validator.New()
 
+	v.Check(input.ChannelId != "", "channel_id", "must be provided")
+	v.Check(input.IsRoot || input.ParentId != "", "parent_id", "must be provided for a non-root session")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.getOwnedChannel(r, input.ChannelId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	if input.ParentId != "" {
-		parentSession, err := app.models.Sessions.GetById(input.ParentId)
+		parentSession, err := app.getOwnedSession(r, input.ParentId)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				v.AddError("session", "not found")
-				app.failedValidationResponse(w, r, v.Errors)
+				app.notFoundResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
+
+		if parentSession.ChannelId != input.ChannelId {
+			v.AddError("parent_id", "must belong to the same channel")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
 		session.Messages = parentSession.Messages
+		session.Context = parentSession.Context
+		session.Compacted = parentSession.Compacted
+
+		session.ForkInstructions, err = app.effectiveInstructions(r, parentSession)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 	}
 
-	sessionId, err := app.models.Sessions.Insert(session)
+	sessionId, err := app.insertSession(r.Context(), session)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrCannotInsert):
@@ -58,58 +91,109 @@ func (app *application) createSessionHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	objID, err := primitive.ObjectIDFromHex(sessionId)
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "Created session successfully", "session_id": sessionId}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
+func (app *application) getSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
 
-	channel := &data.Channel{
-		Sessions: []primitive.ObjectID{objID},
+	session, err := app.getOwnedSession(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	err = app.models.Channel.Update(input.ChannelId, channel)
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"session": session}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
 
-	session.ID, err = primitive.ObjectIDFromHex(sessionId)
+func (app *application) copySessionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SessionId string `json:"session_id"`
+		MessageId string `json:"message_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// get updated tree structure
-	newTree, err := app.getUpdatedTree(session)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	v := validator.New()
+	v.Check(input.SessionId != "", "session_id", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// update tree structure
-	err = app.models.Trees.Update(input.ChannelId, newTree)
+	srcSession, err := app.getOwnedSession(r, input.SessionId)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "Created session successfully", "session_id": sessionId}, nil)
+	// Without a message ID the whole conversation is copied.
+	messages := srcSession.Messages
+	if input.MessageId != "" {
+		index := -1
+		for i, messageId := range srcSession.Messages {
+			if messageId.Hex() == input.MessageId {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			v.AddError("message_id", "not found in session")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		messages = srcSession.Messages[:index+1]
+	}
+
+	session := &data.Session{
+		ChannelId: srcSession.ChannelId,
+		Messages:  append([]primitive.ObjectID{}, messages...),
+		IsRoot:    false,
+		ParentId:  srcSession.ID.Hex(),
+	}
+
+	// The parent's summary still applies when the fork keeps every message
+	// it covers.
+	if srcSession.Compacted <= len(messages) {
+		session.Context = srcSession.Context
+		session.Compacted = srcSession.Compacted
+	}
+
+	// The fork keeps inheriting its parent's instructions, but records the
+	// version it started from.
+	session.ForkInstructions, err = app.effectiveInstructions(r, srcSession)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-}
-func (app *application) getSessionHandler(w http.ResponseWriter, r *http.Request) {
-	id := app.readIDparam(r)
-
-	v := validator.New()
 
-	session, err := app.models.Sessions.GetById(id)
+	sessionId, err := app.insertSession(r.Context(), session)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
+		case errors.Is(err, data.ErrCannotInsert):
+			v.AddError("session", "not able to insert data")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -117,62 +201,59 @@ func (app *application) getSessionHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"session": session}, nil)
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "Copied session successfully", "session_id": sessionId, "parent_id": srcSession.ID.Hex()}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) copySessionHandler(w http.ResponseWriter, r *http.Request) {
-
-}
-
 func (app *application) appendContextHandler(w http.ResponseWriter, r *http.Request) {
 	id := app.readIDparam(r)
 	var input struct {
 		SrcSessionId string `json:"src_session_id"`
 	}
 
-	v := validator.New()
-
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	session, err := app.models.Sessions.GetById(input.SrcSessionId)
+	session, err := app.getOwnedSession(r, input.SrcSessionId)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	newSession := &data.Session{
-		Messages: session.Messages,
-	}
+	// Appending doesn't depend on the destination's existing messages, so
+	// a concurrent change can simply be retried against the new version.
+	err = app.retryOnConflict(func() error {
+		dstSession, err := app.getOwnedSession(r, id)
+		if err != nil {
+			return err
+		}
 
-	err = app.models.Sessions.Update(id, newSession)
+		return app.models.Sessions.AppendMessages(r.Context(), dstSession, session.Messages)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	app.sessionMutex.Lock()
-	delete(app.activeSessions, id)
-	app.sessionMutex.Unlock()
+	app.sessionCache.Invalidate(id)
 
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"result": "Session " + id + " appended context from" + session.ID.Hex()}, nil)
 	if err != nil {
@@ -185,18 +266,50 @@ func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Requ
 	id := app.readIDparam(r)
 
 	v := validator.New()
-	err := app.models.Sessions.Delete(id)
+
+	mode := app.readString(r.URL.Query(), "mode", data.DeleteRestrict)
+	v.Check(validator.In(mode, data.DeleteRestrict, data.DeleteReparent, data.DeleteCascade), "mode", "must be one of restrict, reparent or cascade")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err := app.getOwnedSession(r, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var deleted []string
+	err = app.models.Transaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		deleted, err = app.deleteSession(ctx, id, mode)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrHasChildren):
+			v.AddError("session", "has child sessions, delete with mode=cascade or mode=reparent")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrCannotReparentRoot):
+			v.AddError("mode", "the children of a root session cannot be reparented")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"result": "Session " + id + " deleted successfully"}, nil)
+
+	app.sessionCache.Invalidate(deleted...)
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"result": "Session " + id + " deleted successfully", "deleted": deleted}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -205,11 +318,10 @@ func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Requ
 
 func (app *application) sendSessionMessageHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		SessionId string `json:"session_id"`
-		Data      struct {
-			Role  string              `json:"role"`
-			Parts []map[string]string `json:"parts"`
-		} `json:"data"`
+		SessionId  string               `json:"session_id"`
+		Stream     bool                 `json:"stream"`
+		Data       llm.Data             `json:"data"`
+		Generation llm.GenerationConfig `json:"generation"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -219,187 +331,566 @@ func (app *application) sendSessionMessageHandler(w http.ResponseWriter, r *http
 	}
 	v := validator.New()
 
-	// Create message for DB storage
+	if input.Data.Role == "" {
+		input.Data.Role = "user"
+	}
+
+	data.ValidateMessageData(v, input.Data)
+	if app.validateGeneration(v, input.Generation); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Attachments are referenced by ID; their type and name are recorded
+	// with the message so that it can be sent without looking them up.
+	for _, part := range input.Data.Parts {
+		if part.File == nil {
+			continue
+		}
+
+		attachment, err := app.models.Attachments.GetForUser(r.Context(), part.File.AttachmentId, app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("parts", "file must refer to one of your attachments")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		part.File.MimeType = attachment.MimeType
+		part.File.Name = attachment.Filename
+	}
+
+	// Create message for DB storage. It is only stored together with the
+	// model's reply.
 	message := &data.Message{
 		SessionId: input.SessionId,
 		Data:      input.Data,
 	}
 
-	// Insert user message into database
-	userMessageId, err := app.models.Messages.Insert(message)
+	// Ownership is checked before taking the lock, so that other users can
+	// neither hold a session busy nor learn that it exists.
+	_, err = app.getOwnedSession(r, input.SessionId)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only one message per session is processed at a time, so the cached chat
+	// is never modified concurrently and messages are stored in the order
+	// the model saw them. The lock is held until the reply, streamed or not,
+	// has been saved.
+	if !app.sessionCache.TryLock(input.SessionId) {
+		app.sessionBusyResponse(w, r)
+		return
+	}
+	defer app.sessionCache.Unlock(input.SessionId)
+
+	// The session is read again under the lock; the version read here is
+	// checked when the exchange is saved.
+	session, err := app.models.Sessions.GetById(r.Context(), input.SessionId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkTokenBudget(w, r) {
+		return
+	}
+
+	// Summarizing older turns and generating the reply may each take up to
+	// the retried model call timeout. Streaming lifts the deadline entirely.
+	err = app.extendWriteDeadline(w, 2)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Get or create the chat session
+	chatSession, err := app.getChatSession(r.Context(), session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Settings given with the message apply to it alone.
+	opts, err := app.callOptions(r, session, input.Generation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.Stream && opts.Generation.CandidateCount != nil && *opts.Generation.CandidateCount > 1 {
+		v.AddError("candidate_count", "must be 1 when streaming")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Add current message to the session
+	chatSession.AddMessage(message.Data)
+
+	// Only as much of the history as fits in the context window is sent.
+	history, compactionUsage := app.compactHistory(r, session, chatSession, opts)
+	app.recordUsage(context.WithoutCancel(r.Context()), app.contextGetUser(r).ID, compactionUsage)
+
+	history, err = app.resolveAttachments(r.Context(), history)
+	if err != nil {
+		app.sessionCache.Invalidate(input.SessionId)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.Stream {
+		app.streamSessionMessage(w, r, chatSession, history, opts, session, message)
+		return
+	}
+
+	candidates, usage, err := chatSession.GetCandidates(r.Context(), history, opts)
+	app.recordUsage(context.WithoutCancel(r.Context()), app.contextGetUser(r).ID, usage)
+
+	// The first candidate is the reply and the only one kept in the
+	// history; any others are only returned.
+	var aiResponse string
+	if len(candidates) > 0 {
+		aiResponse, candidates = candidates[0], candidates[1:]
+	}
+
+	// A reply cut off at the token limit is still worth keeping.
+	truncated := errors.Is(err, llm.ErrTruncated) && aiResponse != ""
+	if err != nil && !truncated {
+		// The cached chat already holds the user's message, which was
+		// never stored.
+		app.sessionCache.Invalidate(input.SessionId)
+		app.llmErrorResponse(w, r, err)
+		return
+	}
+
+	// Add AI response to chat history
+	chatSession.AddModelMessage(aiResponse)
+
+	_, err = app.saveExchange(r.Context(), session, message, aiResponse, opts.Generation)
+	if err != nil {
+		// The cached chat now holds an exchange that was never stored, or
+		// one generated from stale history, so it must be rebuilt from what
+		// was actually stored.
+		app.sessionCache.Invalidate(input.SessionId)
+
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		case errors.Is(err, data.ErrCannotInsert):
 			v.AddError("message", "cannot send message")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	userMessageObjId, err := primitive.ObjectIDFromHex(userMessageId)
+
+	app.refreshSummary(r, session, opts)
+
+	env := envelope{"message": aiResponse, "usage": usage, "truncated": truncated, "generation": opts.Generation}
+	if len(candidates) > 0 {
+		env["candidates"] = candidates
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
 
-	// Get or create the chat session
-	app.sessionMutex.RLock()
-	chatSession, exists := app.activeSessions[input.SessionId]
-	app.sessionMutex.RUnlock()
-	if !exists {
-		// Session not in cache, need to build it from DB
-		session, err := app.models.Sessions.GetById(input.SessionId)
-		if err != nil {
-			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				v.AddError("session", "not found")
-				app.failedValidationResponse(w, r, v.Errors)
-			default:
-				app.serverErrorResponse(w, r, err)
-			}
-			return
+// streamSessionMessage relays the model response to the client as
+// server-sent events. The response is persisted once the stream completes,
+// or with whatever was received if the client goes away part way through.
+//
+// The event stream only starts with the first chunk, so a call that fails
+// before producing anything gets an ordinary error response and status.
+func (app *application) streamSessionMessage(w http.ResponseWriter, r *http.Request, chatSession *llm.ChatSession, history []llm.Data, opts llm.Options, session *data.Session, message *data.Message) {
+	rc := http.NewResponseController(w)
+
+	// Long responses must not be cut off by the server's WriteTimeout.
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	started := false
+	aiResponse, usage, err := chatSession.StreamResponse(r.Context(), history, opts, func(chunk string) error {
+		if err := r.Context().Err(); err != nil {
+			return err
 		}
 
-		// Get previous messages
-		previousMessages, err := app.models.Messages.GetAllMesssageById(session.Messages)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		return app.writeEvent(w, rc, "message", envelope{"text": chunk})
+	})
+	app.recordUsage(context.WithoutCancel(r.Context()), app.contextGetUser(r).ID, usage)
+
+	disconnected := r.Context().Err() != nil
+	truncated := errors.Is(err, llm.ErrTruncated) && aiResponse != ""
+	if err != nil && !truncated && !disconnected {
+		app.sessionCache.Invalidate(message.SessionId)
+
+		if !started {
+			app.llmErrorResponse(w, r, err)
 			return
 		}
 
-		// Create new chat session with history
-		chatSession = llm.NewChatSession(app.geminiClient)
-		for _, msg := range previousMessages {
-			if msg.Data.Role == "user" && len(msg.Data.Parts) > 0 {
-				if textValue, ok := msg.Data.Parts[0]["text"]; ok {
-					chatSession.AddUserMessage(textValue)
-				}
-			} else if msg.Data.Role == "model" && len(msg.Data.Parts) > 0 {
-				if textValue, ok := msg.Data.Parts[0]["text"]; ok {
-					chatSession.AddModelMessage(textValue)
-				}
+		// Whatever was streamed is lost, since a failed reply is not saved.
+		app.logError(r, err)
+		_, errorMessage := app.llmError(err)
+		app.writeEvent(w, rc, "error", envelope{"error": errorMessage})
+		return
+	}
+
+	if aiResponse == "" {
+		app.sessionCache.Invalidate(message.SessionId)
+		return
+	}
+
+	chatSession.AddModelMessage(aiResponse)
+
+	// The request context is already cancelled when the client has gone
+	// away, but the partial reply must still be saved.
+	aiMessageId, err := app.saveExchange(context.WithoutCancel(r.Context()), session, message, aiResponse, opts.Generation)
+	if err != nil {
+		app.sessionCache.Invalidate(message.SessionId)
+
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			if !disconnected {
+				app.writeEvent(w, rc, "error", envelope{"error": "unable to update the record due to an edit conflict, please try again"})
+			}
+		default:
+			app.logError(r, err)
+			if !disconnected {
+				app.writeEvent(w, rc, "error", envelope{"error": "the server encountered a problem and could not process your request"})
 			}
 		}
+		return
+	}
 
-		// Store in cache
-		app.sessionMutex.Lock()
-		app.activeSessions[input.SessionId] = chatSession
-		app.sessionMutex.Unlock()
+	app.refreshSummary(r, session, opts)
+
+	if !disconnected {
+		app.writeEvent(w, rc, "done", envelope{"message": aiResponse, "message_id": aiMessageId, "usage": usage, "truncated": truncated, "generation": opts.Generation})
 	}
+}
 
-	// Extract user message text
-	userMessageText := ""
-	if len(input.Data.Parts) > 0 {
-		if text, ok := input.Data.Parts[0]["text"]; ok {
-			userMessageText = text
-		}
+func (app *application) getAllSessionMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	cursor := data.Cursor{
+		Before: app.readInt(qs, "before", 0, v),
+		After:  app.readInt(qs, "after", 0, v),
+		Limit:  app.readInt(qs, "limit", data.DefaultPageSize, v),
 	}
 
-	// Add current message to the session
-	chatSession.AddUserMessage(userMessageText)
+	if data.ValidateCursor(v, cursor); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	// Get AI response using entire conversation history
-	aiResponse, err := chatSession.GetGeminiResponse(chatSession.Messages)
+	session, err := app.getOwnedSession(r, id)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Add AI response to chat history
-	chatSession.AddModelMessage(aiResponse)
+	messages, metadata, err := app.models.Messages.GetForSession(r.Context(), session, cursor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// Create AI message for DB storage
-	aiMessage := &data.Message{
-		SessionId: input.SessionId,
-		Data: struct {
-			Role  string              "json:\"role\""
-			Parts []map[string]string "json:\"parts\""
-		}{
-			Role: "model",
-			Parts: []map[string]string{
-				{"text": aiResponse},
-			},
-		},
+	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
+}
+
+func (app *application) summarizeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
 
-	// Insert AI message into database
-	aiMessageId, err := app.models.Messages.Insert(aiMessage)
+	session, err := app.getOwnedSession(r, id)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrCannotInsert):
-			v.AddError("message", "cannot send message")
-			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	aiMessageObjId, err := primitive.ObjectIDFromHex(aiMessageId)
+
+	v := validator.New()
+	v.Check(len(session.Messages) > 0, "session", "has no messages to summarize")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A summary that already covers every message is returned as it is.
+	if session.SummaryCount != len(session.Messages) {
+		if !app.checkTokenBudget(w, r) {
+			return
+		}
+
+		err = app.extendWriteDeadline(w, 1)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		opts, err := app.callOptions(r, session, llm.GenerationConfig{})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		usage, err := app.summarizeSession(r.Context(), session, opts)
+		app.recordUsage(context.WithoutCancel(r.Context()), app.contextGetUser(r).ID, usage)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.llmErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	env := envelope{
+		"session_id":    session.ID.Hex(),
+		"summary":       session.Summary,
+		"summary_count": session.SummaryCount,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateSessionInstructionsHandler overrides the instructions of a session
+// and the sessions forked from it, or with inherit set, removes the
+// override so that they are inherited again.
+func (app *application) updateSessionInstructionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	var input struct {
+		Text      *string `json:"text"`
+		PersonaId string  `json:"persona_id"`
+		Inherit   bool    `json:"inherit"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// Update session with new message IDs
-	session, err := app.models.Sessions.GetById(input.SessionId)
+	session, err := app.getOwnedSession(r, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	if input.Inherit {
+		v.Check(input.Text == nil && input.PersonaId == "", "inherit", "must not be given together with text or persona_id")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.models.Sessions.ClearInstructions(r.Context(), session)
+	} else {
+		var text string
+		text, err = app.instructionsText(r, v, input.Text, input.PersonaId)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !v.Valid() {
 			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.models.Sessions.UpdateInstructions(r.Context(), session, text, input.PersonaId)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	session.Messages = append(session.Messages, userMessageObjId, aiMessageObjId)
+	app.showSessionInstructions(w, r, session)
+}
 
-	err = app.models.Sessions.Update(input.SessionId, session)
+// getSessionInstructionsHandler returns the instructions in effect for a
+// session and where they come from.
+func (app *application) getSessionInstructionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	session, err := app.getOwnedSession(r, id)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": aiResponse}, nil)
+	app.showSessionInstructions(w, r, session)
+}
+
+func (app *application) showSessionInstructions(w http.ResponseWriter, r *http.Request, session *data.Session) {
+	instructions, err := app.effectiveInstructions(r, session)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	env := envelope{
+		"session_id":        session.ID.Hex(),
+		"instructions":      instructions,
+		"fork_instructions": session.ForkInstructions,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
-func (app *application) getAllSessionMessagesHandler(w http.ResponseWriter, r *http.Request) {
+// updateSessionGenerationHandler replaces the session's own generation
+// settings. Settings it leaves out are inherited, so an empty object makes
+// the session inherit all of them again.
+func (app *application) updateSessionGenerationHandler(w http.ResponseWriter, r *http.Request) {
 	id := app.readIDparam(r)
 
+	var input llm.GenerationConfig
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
 	v := validator.New()
-	session, err := app.models.Sessions.GetById(id)
+
+	if app.validateGeneration(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	session, err := app.getOwnedSession(r, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	messages, err := app.models.Messages.GetAllMesssageById(session.Messages)
+	err = app.models.Sessions.UpdateGeneration(r.Context(), session, input)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("session", "not found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages}, nil)
+	app.showSessionGeneration(w, r, session)
+}
+
+// getSessionGenerationHandler returns the session's own generation settings
+// and those in effect once inherited ones are applied.
+func (app *application) getSessionGenerationHandler(w http.ResponseWriter, r *http.Request) {
+	id := app.readIDparam(r)
+
+	session, err := app.getOwnedSession(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.showSessionGeneration(w, r, session)
+}
+
+func (app *application) showSessionGeneration(w http.ResponseWriter, r *http.Request, session *data.Session) {
+	opts, err := app.callOptions(r, session, llm.GenerationConfig{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	env := envelope{
+		"session_id": session.ID.Hex(),
+		"generation": session.Generation,
+		"effective":  opts.Generation,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
 
 	"github.com/pascaldekloe/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"misc.sahilsasane.net/internal/data"
 	"misc.sahilsasane.net/internal/validator"
 )
@@ -32,7 +34,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -54,24 +56,166 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	env, err := app.issueTokenPair(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new access token and a
+// new refresh token. Refresh tokens are single use, so the old one stops
+// working as soon as it has been exchanged.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.Consume(r.Context(), data.ScopeRefresh, input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentailsReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentailsReponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env, err := app.issueTokenPair(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// logoutHandler revokes the access token used for the request and, when one
+// is given, the refresh token that belongs to it.
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if r.ContentLength > 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	user := app.contextGetUser(r)
+	claims := app.contextGetClaims(r)
+
+	err := app.models.Tokens.Revoke(r.Context(), claims.ID, user.ID, claims.Expires.Time())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.RefreshToken != "" {
+		err = app.models.Tokens.DeleteForToken(r.Context(), data.ScopeRefresh, input.RefreshToken, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "logged out successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeAllTokensHandler logs the user out everywhere by revoking every
+// access and refresh token issued to them.
+func (app *application) revokeAllTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.RevokeAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all tokens revoked successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issueTokenPair signs a short-lived access token and stores a new refresh
+// token for the user. The access token's jti is recorded so that it can be
+// revoked before it expires.
+func (app *application) issueTokenPair(ctx context.Context, user *data.User) (envelope, error) {
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.accessTTL)
+
 	var claims jwt.Claims
 	claims.Subject = user.ID.Hex()
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
+	claims.ID = primitive.NewObjectID().Hex()
+	claims.Issued = jwt.NewNumericTime(now)
+	claims.NotBefore = jwt.NewNumericTime(now)
+	claims.Expires = jwt.NewNumericTime(expiry)
 	claims.Issuer = "misc.sahilsasane.net"
 	claims.Audiences = []string{"misc.sahilsasane.net"}
 
 	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
-	err = app.writeJSON(w, http.StatusCreated,
-		envelope{"authentication_token": string(jwtBytes)}, nil)
+
+	err = app.models.Tokens.TrackAccessToken(ctx, user.ID, claims.ID, expiry)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
+	}
+
+	refreshToken, err := app.models.Tokens.New(ctx, user.ID, app.config.jwt.refreshTTL, data.ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{
+		"authentication_token":        string(jwtBytes),
+		"authentication_token_expiry": expiry,
+		"refresh_token":               refreshToken,
 	}
+
+	return env, nil
 }
 
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +235,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -109,13 +253,24 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	env := envelope{"message": string(token.Plaintext)}
+	app.background(func() {
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -141,7 +296,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -159,13 +314,24 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	env := envelope{"message": string(token.Plaintext)}
+	app.background(func() {
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
 
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AttachmentMimeTypes are the types of file that can be attached to a
+// message.
+var AttachmentMimeTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/webp",
+	"image/heic",
+	"image/heif",
+	"application/pdf",
+	"text/plain",
+}
+
+const attachmentBucket = "attachments"
+
+// transferTimeout bounds uploading or downloading a whole attachment, which
+// can take much longer than a single query.
+const transferTimeout = time.Minute
+
+// Attachment is an uploaded file stored in GridFS. Only the user who
+// uploaded it can read it or attach it to a message.
+type Attachment struct {
+	ID        primitive.ObjectID `json:"id"`
+	UserId    primitive.ObjectID `json:"-"`
+	Filename  string             `json:"filename"`
+	MimeType  string             `json:"mime_type"`
+	Size      int64              `json:"size"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// attachmentFile is the GridFS files document of an attachment.
+type attachmentFile struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Filename   string             `bson:"filename"`
+	Length     int64              `bson:"length"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	Metadata   struct {
+		UserId   primitive.ObjectID `bson:"user_id"`
+		MimeType string             `bson:"mime_type"`
+	} `bson:"metadata"`
+}
+
+type AttachmentModel struct {
+	Database *mongo.Database
+	Timeout  time.Duration
+}
+
+// bucket opens the GridFS bucket. GridFS operations take deadlines rather
+// than contexts, so each operation uses its own bucket to keep deadlines
+// from leaking between concurrent calls.
+func (m AttachmentModel) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(m.Database, options.GridFSBucket().SetName(attachmentBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(transferTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	bucket.SetReadDeadline(deadline)
+	bucket.SetWriteDeadline(deadline)
+
+	return bucket, nil
+}
+
+// Insert stores content as a new attachment and sets its ID and creation
+// time.
+func (m AttachmentModel) Insert(ctx context.Context, attachment *Attachment, content []byte) error {
+	defer observe("AttachmentModel.Insert")()
+
+	bucket, err := m.bucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	metadata := bson.M{
+		"user_id":   attachment.UserId,
+		"mime_type": attachment.MimeType,
+	}
+
+	id, err := bucket.UploadFromStream(attachment.Filename, bytes.NewReader(content), options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return err
+	}
+
+	attachment.ID = id
+	attachment.Size = int64(len(content))
+	attachment.CreatedAt = time.Now()
+	return nil
+}
+
+// GetForUser returns an attachment uploaded by the user, or
+// ErrRecordNotFound.
+func (m AttachmentModel) GetForUser(ctx context.Context, id string, userID primitive.ObjectID) (*Attachment, error) {
+	defer observe("AttachmentModel.GetForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	var file attachmentFile
+	filter := bson.M{"_id": objectId, "metadata.user_id": userID}
+	err = m.Database.Collection(attachmentBucket+".files").FindOne(ctx, filter).Decode(&file)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &Attachment{
+		ID:        file.ID,
+		UserId:    file.Metadata.UserId,
+		Filename:  file.Filename,
+		MimeType:  file.Metadata.MimeType,
+		Size:      file.Length,
+		CreatedAt: file.UploadDate,
+	}, nil
+}
+
+// Content returns the content of an attachment, or ErrRecordNotFound.
+func (m AttachmentModel) Content(ctx context.Context, id string) ([]byte, error) {
+	defer observe("AttachmentModel.Content")()
+
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	bucket, err := m.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	_, err = bucket.DownloadToStream(objectId, &buf)
+	if err != nil {
+		switch {
+		case errors.Is(err, gridfs.ErrFileNotFound):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
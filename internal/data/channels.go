@@ -8,22 +8,31 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"misc.sahilsasane.net/internal/llm"
 )
 
+// Channel groups a tree of sessions. Its instructions and generation
+// settings apply to every session in the tree that does not override them.
 type Channel struct {
-	ID        primitive.ObjectID   `json:"id" bson:"_id"`
-	UserId    string               `json:"user_id" bson:"user_id"`
-	Sessions  []primitive.ObjectID `json:"sessions" bson:"sessions"`
-	Tree      primitive.ObjectID   `json:"tree" bson:"tree"`
-	CreatedAt time.Time            `json:"created_at" bson:"created_at"`
+	ID           primitive.ObjectID    `json:"id" bson:"_id"`
+	UserId       string                `json:"user_id" bson:"user_id"`
+	Sessions     []primitive.ObjectID  `json:"sessions" bson:"sessions"`
+	Tree         primitive.ObjectID    `json:"tree" bson:"tree"`
+	Instructions *Instructions         `json:"instructions,omitempty" bson:"instructions,omitempty"`
+	Generation   *llm.GenerationConfig `json:"generation,omitempty" bson:"generation,omitempty"`
+	CreatedAt    time.Time             `json:"created_at" bson:"created_at"`
 }
 
 type ChannelModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
 }
 
-func (m ChannelModel) Insert(channel *Channel) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m ChannelModel) Insert(ctx context.Context, channel *Channel) (string, error) {
+	defer observe("ChannelModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	channel.CreatedAt = time.Now()
@@ -56,15 +65,17 @@ func (m ChannelModel) Insert(channel *Channel) (string, error) {
 	return channel.ID.Hex(), nil
 }
 
-func (m ChannelModel) GetById(id string) (*Channel, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m ChannelModel) GetById(ctx context.Context, id string) (*Channel, error) {
+	defer observe("ChannelModel.GetById")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	var channel Channel
 
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return nil, ErrRecordNotFound
 	}
 
 	err = m.Collection.FindOne(ctx, bson.M{"_id": primitive.ObjectID(objectID)}).Decode(&channel)
@@ -80,8 +91,38 @@ func (m ChannelModel) GetById(id string) (*Channel, error) {
 	return &channel, nil
 }
 
-func (m ChannelModel) Update(id string, channel *Channel) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetForUser returns a channel only if it belongs to the user, so that
+// channels owned by someone else are indistinguishable from missing ones.
+func (m ChannelModel) GetForUser(ctx context.Context, id string, userID primitive.ObjectID) (*Channel, error) {
+	defer observe("ChannelModel.GetForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var channel Channel
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	err = m.Collection.FindOne(ctx, bson.M{"_id": objectID, "user_id": userID}).Decode(&channel)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &channel, nil
+}
+
+func (m ChannelModel) Update(ctx context.Context, id string, channel *Channel) error {
+	defer observe("ChannelModel.Update")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	objectID, err := primitive.ObjectIDFromHex(id)
@@ -106,3 +147,68 @@ func (m ChannelModel) Update(id string, channel *Channel) error {
 
 	return nil
 }
+
+// UpdateInstructions replaces the channel's instructions. Empty text leaves
+// the channel without a system prompt.
+func (m ChannelModel) UpdateInstructions(ctx context.Context, channel *Channel, text, personaId string) error {
+	defer observe("ChannelModel.UpdateInstructions")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := m.Collection.FindOneAndUpdate(ctx, bson.M{"_id": channel.ID}, instructionsUpdate(text, personaId), opts).Decode(channel)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateGeneration replaces the channel's generation settings. Settings
+// left unset keep the provider's defaults.
+func (m ChannelModel) UpdateGeneration(ctx context.Context, channel *Channel, cfg llm.GenerationConfig) error {
+	defer observe("ChannelModel.UpdateGeneration")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.Collection.UpdateOne(ctx, bson.M{"_id": channel.ID}, generationUpdate(cfg))
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+
+	channel.Generation = nil
+	if !cfg.IsZero() {
+		channel.Generation = &cfg
+	}
+	return nil
+}
+
+// RemoveSessions removes deleted sessions from the channel.
+func (m ChannelModel) RemoveSessions(ctx context.Context, id string, sessionIds []primitive.ObjectID) error {
+	defer observe("ChannelModel.RemoveSessions")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Collection.UpdateOne(ctx,
+		bson.M{"_id": objectID},
+		bson.M{"$pull": bson.M{"sessions": bson.M{"$in": sessionIds}}},
+	)
+	return err
+}
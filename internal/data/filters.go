@@ -0,0 +1,68 @@
+package data
+
+import "misc.sahilsasane.net/internal/validator"
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+// Cursor selects a page of a session's messages by sequence number. Only
+// messages after After and before Before are returned; a zero value leaves
+// that side open. With only After set the page is filled forwards from it;
+// otherwise it is filled backwards from Before or from the latest message,
+// so with neither set the most recent Limit messages are returned.
+type Cursor struct {
+	Before int
+	After  int
+	Limit  int
+}
+
+func ValidateCursor(v *validator.Validator, c Cursor) {
+	v.Check(c.Before >= 0, "before", "must be a positive sequence number")
+	v.Check(c.After >= 0, "after", "must be a positive sequence number")
+	v.Check(c.Before == 0 || c.After < c.Before, "after", "must be less than before")
+	v.Check(c.Limit > 0, "limit", "must be greater than zero")
+	v.Check(c.Limit <= MaxPageSize, "limit", "must be a maximum of 100")
+}
+
+// Metadata describes a page of messages. FirstSequence and LastSequence are
+// the cursors for the previous and next pages.
+type Metadata struct {
+	Limit         int  `json:"limit"`
+	TotalMessages int  `json:"total_messages"`
+	FirstSequence int  `json:"first_sequence,omitempty"`
+	LastSequence  int  `json:"last_sequence,omitempty"`
+	HasBefore     bool `json:"has_before"`
+	HasAfter      bool `json:"has_after"`
+}
+
+// page returns the 0-based bounds [start, end) of the messages selected by c
+// from a history of total messages, along with the page's metadata.
+func (c Cursor) page(total int) (int, int, Metadata) {
+	end := total
+	if c.Before > 0 && c.Before-1 < end {
+		end = c.Before - 1
+	}
+
+	start := min(c.After, end)
+	if c.Before > 0 || c.After == 0 {
+		// Pages that end at a fixed point are filled backwards from it.
+		start = max(start, end-c.Limit)
+	} else {
+		end = min(end, start+c.Limit)
+	}
+
+	metadata := Metadata{
+		Limit:         c.Limit,
+		TotalMessages: total,
+		HasBefore:     start > 0,
+		HasAfter:      end < total,
+	}
+	if start < end {
+		metadata.FirstSequence = start + 1
+		metadata.LastSequence = end
+	}
+
+	return start, end, metadata
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"testing"
+
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func TestCursorPage(t *testing.T) {
+	tests := []struct {
+		name      string
+		cursor    Cursor
+		total     int
+		wantStart int
+		wantEnd   int
+		want      Metadata
+	}{
+		{
+			name:      "latest messages",
+			cursor:    Cursor{Limit: 3},
+			total:     10,
+			wantStart: 7,
+			wantEnd:   10,
+			want:      Metadata{FirstSequence: 8, LastSequence: 10, HasBefore: true},
+		},
+		{
+			name:      "forwards from after",
+			cursor:    Cursor{After: 2, Limit: 3},
+			total:     10,
+			wantStart: 2,
+			wantEnd:   5,
+			want:      Metadata{FirstSequence: 3, LastSequence: 5, HasBefore: true, HasAfter: true},
+		},
+		{
+			name:      "backwards from before",
+			cursor:    Cursor{Before: 5, Limit: 3},
+			total:     10,
+			wantStart: 1,
+			wantEnd:   4,
+			want:      Metadata{FirstSequence: 2, LastSequence: 4, HasBefore: true, HasAfter: true},
+		},
+		{
+			name:      "between after and before",
+			cursor:    Cursor{After: 1, Before: 3, Limit: 10},
+			total:     10,
+			wantStart: 1,
+			wantEnd:   2,
+			want:      Metadata{FirstSequence: 2, LastSequence: 2, HasBefore: true, HasAfter: true},
+		},
+		{
+			name:      "before past the end",
+			cursor:    Cursor{Before: 20, Limit: 3},
+			total:     10,
+			wantStart: 7,
+			wantEnd:   10,
+			want:      Metadata{FirstSequence: 8, LastSequence: 10, HasBefore: true},
+		},
+		{
+			name:      "after past the end",
+			cursor:    Cursor{After: 15, Limit: 3},
+			total:     10,
+			wantStart: 10,
+			wantEnd:   10,
+			want:      Metadata{HasBefore: true},
+		},
+		{
+			name:      "limit covers everything",
+			cursor:    Cursor{Limit: 50},
+			total:     10,
+			wantStart: 0,
+			wantEnd:   10,
+			want:      Metadata{FirstSequence: 1, LastSequence: 10},
+		},
+		{
+			name:      "no messages",
+			cursor:    Cursor{Limit: 3},
+			total:     0,
+			wantStart: 0,
+			wantEnd:   0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, metadata := tt.cursor.page(tt.total)
+
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("got [%d, %d); want [%d, %d)", start, end, tt.wantStart, tt.wantEnd)
+			}
+
+			tt.want.Limit = tt.cursor.Limit
+			tt.want.TotalMessages = tt.total
+			if metadata != tt.want {
+				t.Errorf("got metadata %+v; want %+v", metadata, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  Cursor
+		wantErr string
+	}{
+		{name: "default", cursor: Cursor{Limit: DefaultPageSize}},
+		{name: "after and before", cursor: Cursor{After: 1, Before: 5, Limit: 10}},
+		{name: "negative before", cursor: Cursor{Before: -1, Limit: 10}, wantErr: "before"},
+		{name: "negative after", cursor: Cursor{After: -1, Limit: 10}, wantErr: "after"},
+		{name: "after not before before", cursor: Cursor{After: 5, Before: 5, Limit: 10}, wantErr: "after"},
+		{name: "zero limit", cursor: Cursor{}, wantErr: "limit"},
+		{name: "limit too large", cursor: Cursor{Limit: MaxPageSize + 1}, wantErr: "limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateCursor(v, tt.cursor)
+
+			checkErrors(t, v, tt.wantErr)
+		})
+	}
+}
+
+// checkErrors fails the test unless v holds an error for key, or no errors
+// when key is empty.
+func checkErrors(t *testing.T, v *validator.Validator, key string) {
+	t.Helper()
+
+	switch {
+	case key == "" && !v.Valid():
+		t.Errorf("got errors %v; want none", v.Errors)
+	case key != "" && v.Errors[key] == "":
+		t.Errorf("got errors %v; want one for %q", v.Errors, key)
+	}
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+// ModelRX matches the model names that can be selected. Names are sent in
+// request URLs, so they are kept to the characters providers use.
+var ModelRX = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/@-]*$`)
+
+// ValidateGenerationConfig checks the form of generation settings. Whether
+// the provider supports them is only known once they are sent.
+func ValidateGenerationConfig(v *validator.Validator, cfg llm.GenerationConfig) {
+	if cfg.Model != "" {
+		v.Check(len(cfg.Model) <= 100, "model", "must not be more than 100 bytes long")
+		v.Check(validator.Matches(cfg.Model, ModelRX) && !strings.Contains(cfg.Model, ".."), "model", "must be a valid model name")
+	}
+	if cfg.Temperature != nil {
+		v.Check(*cfg.Temperature >= 0 && *cfg.Temperature <= 2, "temperature", "must be between 0 and 2")
+	}
+	if cfg.TopP != nil {
+		v.Check(*cfg.TopP >= 0 && *cfg.TopP <= 1, "top_p", "must be between 0 and 1")
+	}
+	if cfg.TopK != nil {
+		v.Check(*cfg.TopK >= 1 && *cfg.TopK <= 1000, "top_k", "must be between 1 and 1000")
+	}
+	if cfg.MaxOutputTokens != nil {
+		v.Check(*cfg.MaxOutputTokens >= 1 && *cfg.MaxOutputTokens <= 65536, "max_output_tokens", "must be between 1 and 65536")
+	}
+	if cfg.CandidateCount != nil {
+		v.Check(*cfg.CandidateCount >= 1 && *cfg.CandidateCount <= 8, "candidate_count", "must be between 1 and 8")
+	}
+
+	v.Check(len(cfg.StopSequences) <= 5, "stop_sequences", "must not contain more than 5 sequences")
+	for _, stop := range cfg.StopSequences {
+		v.Check(stop != "", "stop_sequences", "must not contain empty sequences")
+		v.Check(len(stop) <= 100, "stop_sequences", "must not contain sequences more than 100 bytes long")
+	}
+}
+
+// generationUpdate replaces the stored settings, or removes them when none
+// are set so that they are inherited again.
+func generationUpdate(cfg llm.GenerationConfig) bson.M {
+	if cfg.IsZero() {
+		return bson.M{"$unset": bson.M{"generation": ""}}
+	}
+	return bson.M{"$set": bson.M{"generation": cfg}}
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func TestValidateGenerationConfig(t *testing.T) {
+	float := func(f float64) *float64 { return &f }
+	integer := func(i int) *int { return &i }
+
+	tests := []struct {
+		name    string
+		cfg     llm.GenerationConfig
+		wantErr string
+	}{
+		{name: "empty", cfg: llm.GenerationConfig{}},
+		{
+			name: "all set",
+			cfg: llm.GenerationConfig{
+				Model:           "models/gemini-2.0-flash",
+				Temperature:     float(0.7),
+				TopP:            float(1),
+				TopK:            integer(40),
+				MaxOutputTokens: integer(1024),
+				StopSequences:   []string{"END"},
+				CandidateCount:  integer(2),
+			},
+		},
+		{name: "model with a space", cfg: llm.GenerationConfig{Model: "gpt 4"}, wantErr: "model"},
+		{name: "model with dots", cfg: llm.GenerationConfig{Model: "../admin"}, wantErr: "model"},
+		{name: "model too long", cfg: llm.GenerationConfig{Model: strings.Repeat("a", 101)}, wantErr: "model"},
+		{name: "temperature too high", cfg: llm.GenerationConfig{Temperature: float(2.1)}, wantErr: "temperature"},
+		{name: "negative top_p", cfg: llm.GenerationConfig{TopP: float(-0.1)}, wantErr: "top_p"},
+		{name: "zero top_k", cfg: llm.GenerationConfig{TopK: integer(0)}, wantErr: "top_k"},
+		{name: "max_output_tokens too large", cfg: llm.GenerationConfig{MaxOutputTokens: integer(65537)}, wantErr: "max_output_tokens"},
+		{name: "too many candidates", cfg: llm.GenerationConfig{CandidateCount: integer(9)}, wantErr: "candidate_count"},
+		{name: "too many stop sequences", cfg: llm.GenerationConfig{StopSequences: []string{"a", "b", "c", "d", "e", "f"}}, wantErr: "stop_sequences"},
+		{name: "empty stop sequence", cfg: llm.GenerationConfig{StopSequences: []string{""}}, wantErr: "stop_sequences"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateGenerationConfig(v, tt.cfg)
+
+			checkErrors(t, v, tt.wantErr)
+		})
+	}
+}
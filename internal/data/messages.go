@@ -8,23 +8,60 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/validator"
 )
 
+// Message is a single turn of a conversation. Sequence is its 1-based
+// position in the session it was sent to. Forks and appended context share
+// messages between sessions, so messages listed for a session have Sequence
+// set to their position in that session instead. Replies record the
+// Generation settings they were generated with, so that branches can be
+// compared.
 type Message struct {
-	ID        primitive.ObjectID `json:"id" bson:"_id"`
-	SessionId string             `json:"session_id" bson:"session_id"`
-	Data      struct {
-		Role  string              `json:"role"`
-		Parts []map[string]string `json:"parts"`
-	} `json:"data"`
+	ID         primitive.ObjectID    `json:"id" bson:"_id"`
+	SessionId  string                `json:"session_id" bson:"session_id"`
+	Sequence   int                   `json:"sequence" bson:"sequence"`
+	CreatedAt  time.Time             `json:"created_at" bson:"created_at"`
+	Data       llm.Data              `json:"data"`
+	Generation *llm.GenerationConfig `json:"generation,omitempty" bson:"generation,omitempty"`
+}
+
+// ValidateMessageData checks a message sent by a user. Attachments are only
+// checked for their form here; the caller makes sure that the attachments
+// referenced exist and belong to the user.
+func ValidateMessageData(v *validator.Validator, d llm.Data) {
+	v.Check(d.Role == "user", "role", "must be user")
+	v.Check(len(d.Parts) > 0, "parts", "must contain at least one part")
+	v.Check(len(d.Parts) <= 20, "parts", "must not contain more than 20 parts")
+
+	for _, part := range d.Parts {
+		set := 0
+		if part.Text != "" {
+			set++
+		}
+		if part.InlineData != nil {
+			set++
+			v.Check(validator.In(part.InlineData.MimeType, AttachmentMimeTypes...), "parts", "inline_data must have a supported mime_type")
+			v.Check(len(part.InlineData.Data) > 0, "parts", "inline_data must not be empty")
+		}
+		if part.File != nil {
+			set++
+			v.Check(part.File.AttachmentId != "", "parts", "file must have an attachment_id")
+		}
+		v.Check(set == 1, "parts", "each part must have exactly one of text, inline_data or file")
+	}
 }
 
 type MessageModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
 }
 
-func (m MessageModel) Insert(message *Message) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m MessageModel) Insert(ctx context.Context, message *Message) (string, error) {
+	defer observe("MessageModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	sessionObjectId, err := primitive.ObjectIDFromHex(message.SessionId)
@@ -32,10 +69,17 @@ func (m MessageModel) Insert(message *Message) (string, error) {
 		return "", err
 	}
 
+	message.CreatedAt = time.Now()
+
 	messageDoc := bson.M{
 		"session_id": sessionObjectId,
+		"sequence":   message.Sequence,
+		"created_at": message.CreatedAt,
 		"data":       message.Data,
 	}
+	if message.Generation != nil {
+		messageDoc["generation"] = message.Generation
+	}
 
 	res, err := m.Collection.InsertOne(ctx, messageDoc)
 	if err != nil {
@@ -51,8 +95,10 @@ func (m MessageModel) Insert(message *Message) (string, error) {
 	return message.ID.Hex(), nil
 }
 
-func (m MessageModel) GetById(id string) (*Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m MessageModel) GetById(ctx context.Context, id string) (*Message, error) {
+	defer observe("MessageModel.GetById")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	var message Message
@@ -73,26 +119,100 @@ func (m MessageModel) GetById(id string) (*Message, error) {
 	return &message, nil
 }
 
-func (m MessageModel) GetAllMesssageById(ids []primitive.ObjectID) ([]*Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// GetAllMesssageById returns the messages with the given IDs in the order of
+// ids. Messages that no longer exist are skipped.
+func (m MessageModel) GetAllMesssageById(ctx context.Context, ids []primitive.ObjectID) ([]*Message, error) {
+	defer observe("MessageModel.GetAllMesssageById")()
+
+	return m.getOrdered(ctx, ids)
+}
+
+// GetForSession returns a page of the session's messages in conversation
+// order, with Sequence set to each message's position in the session. A
+// message that appears in the session more than once, such as after a fork
+// is appended back onto its source, is returned once per position.
+func (m MessageModel) GetForSession(ctx context.Context, session *Session, cursor Cursor) ([]*Message, Metadata, error) {
+	defer observe("MessageModel.GetForSession")()
+
+	start, end, metadata := cursor.page(len(session.Messages))
+
+	ids := session.Messages[start:end]
+	byId, err := m.find(ctx, ids)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	messages := make([]*Message, 0, len(ids))
+	for i, id := range ids {
+		if message, ok := byId[id]; ok {
+			message := *message
+			message.Sequence = start + i + 1
+			messages = append(messages, &message)
+		}
+	}
+
+	return messages, metadata, nil
+}
+
+// getOrdered returns the messages with the given IDs in the order of ids,
+// skipping any that no longer exist. Each position gets its own copy, so a
+// repeated ID yields distinct messages.
+func (m MessageModel) getOrdered(ctx context.Context, ids []primitive.ObjectID) ([]*Message, error) {
+	byId, err := m.find(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		if message, ok := byId[id]; ok {
+			message := *message
+			messages = append(messages, &message)
+		}
+	}
+
+	return messages, nil
+}
 
-	filter := bson.M{"_id": bson.M{"$in": ids}}
+// find returns the messages with the given IDs by ID.
+func (m MessageModel) find(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]*Message, error) {
+	byId := map[primitive.ObjectID]*Message{}
+	if len(ids) == 0 {
+		return byId, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
 
-	cursor, err := m.Collection.Find(ctx, filter)
+	cursor, err := m.Collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var messages []*Message
-	if err = cursor.All(ctx, &messages); err != nil {
+	var found []*Message
+	if err = cursor.All(ctx, &found); err != nil {
 		return nil, err
 	}
 
-	if len(messages) == 0 {
-		return nil, nil
+	for _, message := range found {
+		byId[message.ID] = message
 	}
 
-	return messages, nil
+	return byId, nil
+}
+
+// DeleteMany removes the messages with the given IDs.
+func (m MessageModel) DeleteMany(ctx context.Context, ids []primitive.ObjectID) error {
+	defer observe("MessageModel.DeleteMany")()
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.Collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
 }
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"context"
+)
+
+// MigrateTreePaths moves channels created before sessions carried their own
+// place in the tree onto the current layout. Those channels kept the whole
+// structure as nested nodes on the tree document and stored the channel ID
+// as each session's parent_id. The nested structure is walked to set every
+// session's parent_id, path and depth, and is then removed, so the migration
+// only does work once and can safely be run on every start. It returns the
+// number of sessions updated.
+func (m Models) MigrateTreePaths(ctx context.Context) (int, error) {
+	trees, err := m.Trees.GetLegacy(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, tree := range trees {
+		// The transaction may run more than once, so only the count of the
+		// run that commits is kept.
+		var count int
+		err := m.Transaction(ctx, func(ctx context.Context) error {
+			var err error
+			count, err = m.migrateNode(ctx, tree.Structure, "", nil)
+			if err != nil {
+				return err
+			}
+
+			return m.Trees.ClearLegacy(ctx, tree.ID)
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += count
+	}
+
+	// Roots that never made it into a legacy structure still need a path.
+	count, err := m.Sessions.SetMissingRootPaths(ctx)
+	if err != nil {
+		return migrated, err
+	}
+
+	return migrated + count, nil
+}
+
+// migrateNode sets the place in the tree of the session at node and of every
+// session below it.
+func (m Models) migrateNode(ctx context.Context, node legacyTreeNode, parentId string, path []string) (int, error) {
+	if node.Root == "" {
+		return 0, nil
+	}
+
+	count := 0
+	updated, err := m.Sessions.SetPath(ctx, node.Root, parentId, path)
+	if err != nil {
+		return 0, err
+	}
+	if updated {
+		count++
+	}
+
+	childPath := append(path[:len(path):len(path)], node.Root)
+	for _, child := range node.Children {
+		n, err := m.migrateNode(ctx, child, node.Root, childPath)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+
+	return count, nil
+}
@@ -1,9 +1,13 @@
 package data
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"misc.sahilsasane.net/internal/metrics"
 )
 
 var (
@@ -12,30 +16,118 @@ var (
 	ErrCannotInsert   = errors.New("cannot insert record")
 )
 
+// versionFilter adds an optimistic concurrency check on version to filter.
+// Documents written before versions were tracked have no version field and
+// are read as version 0, so version 0 also matches a missing field. Their
+// first update sets the field, after which the check is exact.
+func versionFilter(filter bson.M, version int) bson.M {
+	if version == 0 {
+		filter["$or"] = bson.A{
+			bson.M{"version": 0},
+			bson.M{"version": bson.M{"$exists": false}},
+		}
+		return filter
+	}
+
+	filter["version"] = version
+	return filter
+}
+
+var queryDuration = metrics.NewHistogramVec(
+	"db_query_duration_seconds",
+	"Duration of database operations by model method.",
+	metrics.DefBuckets,
+	"method",
+)
+
+// observe records how long a model method takes. It is used as
+// defer observe("SessionModel.GetById")().
+func observe(method string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.Observe(time.Since(start).Seconds(), method)
+	}
+}
+
 type Models struct {
-	Users    UserModel
-	Tokens   TokenModel
-	Sessions SessionModel
-	Messages MessageModel
-	Trees    TreeModel
-	Channel  ChannelModel
+	Users       UserModel
+	Tokens      TokenModel
+	Sessions    SessionModel
+	Messages    MessageModel
+	Trees       TreeModel
+	Channel     ChannelModel
+	Usage       UsageModel
+	Attachments AttachmentModel
+	Personas    PersonaModel
+
+	client       *mongo.Client
+	transactions bool
 }
 
-func NewModels(client *mongo.Client, dbName string) Models {
+// NewModels creates the models for dbName. timeout bounds every single
+// database operation in addition to the deadline of the caller's context.
+func NewModels(client *mongo.Client, dbName string, transactions bool, timeout time.Duration) Models {
 	db := client.Database(dbName)
-	users := UserModel{Collection: db.Collection("users")}
+	users := UserModel{Collection: db.Collection("users"), Timeout: timeout}
+	sessions := SessionModel{Collection: db.Collection("sessions"), Timeout: timeout}
+	tokens := TokenModel{Collection: db.Collection("tokens"), Timeout: timeout}
+	usage := UsageModel{Collection: db.Collection("usage"), Timeout: timeout}
+	personas := PersonaModel{Collection: db.Collection("personas"), Timeout: timeout}
 
 	// Create indexes on startup
 	if err := users.CreateIndexes(); err != nil {
 		panic(err) // In a production app, you might want to handle this error differently
 	}
+	if err := sessions.CreateIndexes(); err != nil {
+		panic(err)
+	}
+	if err := tokens.CreateIndexes(); err != nil {
+		panic(err)
+	}
+	if err := usage.CreateIndexes(); err != nil {
+		panic(err)
+	}
+	if err := personas.CreateIndexes(); err != nil {
+		panic(err)
+	}
 
 	return Models{
-		Users:    users,
-		Tokens:   TokenModel{Collection: db.Collection("tokens")},
-		Channel:  ChannelModel{Collection: db.Collection("channels")},
-		Trees:    TreeModel{Collection: db.Collection("trees")},
-		Sessions: SessionModel{Collection: db.Collection("sessions")},
-		Messages: MessageModel{Collection: db.Collection("messages")},
+		Users:        users,
+		Tokens:       tokens,
+		Channel:      ChannelModel{Collection: db.Collection("channels"), Timeout: timeout},
+		Trees:        TreeModel{Collection: db.Collection("trees"), Timeout: timeout},
+		Sessions:     sessions,
+		Messages:     MessageModel{Collection: db.Collection("messages"), Timeout: timeout},
+		Usage:        usage,
+		Attachments:  AttachmentModel{Database: db, Timeout: timeout},
+		Personas:     personas,
+		client:       client,
+		transactions: transactions,
+	}
+}
+
+// Transaction runs fn inside a multi-document transaction. Model methods
+// called with the ctx passed to fn take part in the transaction. The driver
+// retries fn when the transaction fails with a TransientTransactionError and
+// retries the commit on UnknownTransactionCommitResult, so fn must be safe to
+// run more than once.
+//
+// Transactions need a replica set or sharded cluster. When they are disabled
+// fn runs directly with ctx.
+func (m Models) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !m.transactions {
+		return fn(ctx)
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
 	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+
+	return err
 }
@@ -0,0 +1,223 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+var ErrDuplicatePersona = errors.New("duplicate persona name")
+
+const (
+	InstructionsChannel = "channel"
+	InstructionsSession = "session"
+)
+
+// Instructions is the system prompt of a channel or a session. A persona's
+// instructions are copied when it is applied, so later edits to the persona
+// only take effect once it is applied again. Version counts the changes made
+// to the channel's or the session's instructions.
+type Instructions struct {
+	Text      string    `json:"text" bson:"text"`
+	PersonaId string    `json:"persona_id,omitempty" bson:"persona_id,omitempty"`
+	Version   int       `json:"version" bson:"version"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// EffectiveInstructions are the instructions in effect for a session along
+// with where they come from: the channel, or the session or ancestor
+// identified by SourceId.
+type EffectiveInstructions struct {
+	Instructions `bson:",inline"`
+	Source       string `json:"source" bson:"source"`
+	SourceId     string `json:"source_id" bson:"source_id"`
+}
+
+func ValidateInstructions(v *validator.Validator, text string) {
+	v.Check(len(text) <= 20000, "text", "must not be more than 20000 bytes long")
+}
+
+// Persona is a named set of instructions that a user can apply to any of
+// their channels and sessions.
+type Persona struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	UserId       primitive.ObjectID `json:"-" bson:"user_id"`
+	Name         string             `json:"name" bson:"name"`
+	Instructions string             `json:"instructions" bson:"instructions"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	Version      int                `json:"version" bson:"version"`
+}
+
+func ValidatePersona(v *validator.Validator, persona *Persona) {
+	v.Check(persona.Name != "", "name", "must be provided")
+	v.Check(len(persona.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(persona.Instructions != "", "instructions", "must be provided")
+	v.Check(len(persona.Instructions) <= 20000, "instructions", "must not be more than 20000 bytes long")
+}
+
+type PersonaModel struct {
+	Collection *mongo.Collection
+	Timeout    time.Duration
+}
+
+func (m PersonaModel) CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	return err
+}
+
+func (m PersonaModel) Insert(ctx context.Context, persona *Persona) error {
+	defer observe("PersonaModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	persona.ID = primitive.NewObjectID()
+	persona.CreatedAt = time.Now()
+	persona.Version = 1
+
+	_, err := m.Collection.InsertOne(ctx, persona)
+	if err != nil {
+		switch {
+		case mongo.IsDuplicateKeyError(err):
+			return ErrDuplicatePersona
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetForUser returns one of the user's personas, or ErrRecordNotFound.
+func (m PersonaModel) GetForUser(ctx context.Context, id string, userID primitive.ObjectID) (*Persona, error) {
+	defer observe("PersonaModel.GetForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	var persona Persona
+	err = m.Collection.FindOne(ctx, bson.M{"_id": objectID, "user_id": userID}).Decode(&persona)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &persona, nil
+}
+
+// GetAllForUser returns the user's personas ordered by name.
+func (m PersonaModel) GetAllForUser(ctx context.Context, userID primitive.ObjectID) ([]*Persona, error) {
+	defer observe("PersonaModel.GetAllForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	cursor, err := m.Collection.Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	personas := []*Persona{}
+	if err = cursor.All(ctx, &personas); err != nil {
+		return nil, err
+	}
+
+	return personas, nil
+}
+
+// Update saves the persona's name and instructions. It fails with
+// ErrEditConflict when the persona has changed since it was read.
+func (m PersonaModel) Update(ctx context.Context, persona *Persona) error {
+	defer observe("PersonaModel.Update")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	personaDoc := bson.M{
+		"$set": bson.M{
+			"name":         persona.Name,
+			"instructions": persona.Instructions,
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+
+	res, err := m.Collection.UpdateOne(ctx, bson.M{"_id": persona.ID, "version": persona.Version}, personaDoc)
+	if err != nil {
+		switch {
+		case mongo.IsDuplicateKeyError(err):
+			return ErrDuplicatePersona
+		default:
+			return err
+		}
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrEditConflict
+	}
+
+	persona.Version++
+	return nil
+}
+
+func (m PersonaModel) DeleteForUser(ctx context.Context, id string, userID primitive.ObjectID) error {
+	defer observe("PersonaModel.DeleteForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrRecordNotFound
+	}
+
+	res, err := m.Collection.DeleteOne(ctx, bson.M{"_id": objectID, "user_id": userID})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// instructionsUpdate sets new instructions and bumps their version in a
+// single update, so concurrent changes never share a version.
+func instructionsUpdate(text, personaId string) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"instructions.text":       text,
+			"instructions.persona_id": personaId,
+			"instructions.updated_at": time.Now(),
+		},
+		"$inc": bson.M{
+			"instructions.version": 1,
+		},
+	}
+}
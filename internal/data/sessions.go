@@ -8,23 +8,74 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"misc.sahilsasane.net/internal/llm"
 )
 
+const (
+	DeleteRestrict = "restrict"
+	DeleteReparent = "reparent"
+	DeleteCascade  = "cascade"
+)
+
+var (
+	ErrHasChildren        = errors.New("session has child sessions")
+	ErrCannotReparentRoot = errors.New("cannot reparent the children of a root session")
+	ErrInvalidDeleteMode  = errors.New("invalid delete mode")
+)
+
+// Session is a node in a channel's conversation tree. Path holds the IDs of
+// every ancestor from the root down to the parent, so subtree queries only
+// need an index on path. Context is a summary of the first Compacted
+// messages, used in their place once the history outgrows the model's
+// context window. Summary is a short description of the conversation for
+// tree views, covering its first SummaryCount messages. Instructions
+// override the channel's for the session and its descendants, and
+// ForkInstructions records the instructions in effect when the session was
+// forked. Generation overrides the generation settings of its ancestors
+// and channel one setting at a time. Version is bumped whenever messages
+// are appended or the context changes.
 type Session struct {
-	ID        primitive.ObjectID   `json:"id" bson:"_id"`
-	ChannelId string               `json:"channel_id" bson:"channel_id"`
-	Messages  []primitive.ObjectID `json:"messages" bson:"messages"`
-	Context   string               `json:"context" bson:"context"`
-	IsRoot    bool                 `json:"is_root" bson:"is_root"`
-	ParentId  string               `json:"parent_id" bson:"parent_id"`
+	ID               primitive.ObjectID     `json:"id" bson:"_id"`
+	ChannelId        string                 `json:"channel_id" bson:"channel_id"`
+	Messages         []primitive.ObjectID   `json:"messages" bson:"messages"`
+	Context          string                 `json:"context" bson:"context"`
+	Compacted        int                    `json:"compacted" bson:"compacted"`
+	Summary          string                 `json:"summary" bson:"summary"`
+	SummaryCount     int                    `json:"summary_count" bson:"summary_count"`
+	Instructions     *Instructions          `json:"instructions,omitempty" bson:"instructions,omitempty"`
+	ForkInstructions *EffectiveInstructions `json:"fork_instructions,omitempty" bson:"fork_instructions,omitempty"`
+	Generation       *llm.GenerationConfig  `json:"generation,omitempty" bson:"generation,omitempty"`
+	IsRoot           bool                   `json:"is_root" bson:"is_root"`
+	ParentId         string                 `json:"parent_id" bson:"parent_id"`
+	Path             []primitive.ObjectID   `json:"path" bson:"path"`
+	Depth            int                    `json:"depth" bson:"depth"`
+	CreatedAt        time.Time              `json:"created_at" bson:"created_at"`
+	Version          int                    `json:"version" bson:"version"`
 }
 
 type SessionModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
+}
+
+func (m SessionModel) CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.Collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "channel_id", Value: 1}}},
+		{Keys: bson.D{{Key: "parent_id", Value: 1}}},
+		{Keys: bson.D{{Key: "path", Value: 1}}},
+	})
+
+	return err
 }
 
-func (m SessionModel) Insert(session *Session) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m SessionModel) Insert(ctx context.Context, session *Session) (string, error) {
+	defer observe("SessionModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	channelObjectID, err := primitive.ObjectIDFromHex(session.ChannelId)
@@ -32,21 +83,51 @@ func (m SessionModel) Insert(session *Session) (string, error) {
 		return "", err
 	}
 
+	session.CreatedAt = time.Now()
+	session.Path = []primitive.ObjectID{}
+	session.Depth = 0
+	session.Version = 1
+
 	sessionDoc := bson.M{
-		"channel_id": channelObjectID,
-		"messages":   session.Messages,
-		"context":    session.Context,
-		"is_root":    session.IsRoot,
+		"channel_id":    channelObjectID,
+		"messages":      session.Messages,
+		"context":       session.Context,
+		"compacted":     session.Compacted,
+		"summary":       session.Summary,
+		"summary_count": session.SummaryCount,
+		"is_root":       session.IsRoot,
+		"created_at":    session.CreatedAt,
+		"version":       session.Version,
 	}
 
 	if !session.IsRoot {
-		parentObjectID, err := primitive.ObjectIDFromHex(session.ChannelId)
+		parentObjectID, err := primitive.ObjectIDFromHex(session.ParentId)
 		if err != nil {
 			return "", err
 		}
+
+		var parent Session
+		err = m.Collection.FindOne(ctx, bson.M{"_id": parentObjectID}).Decode(&parent)
+		if err != nil {
+			switch {
+			case errors.Is(err, mongo.ErrNoDocuments):
+				return "", ErrRecordNotFound
+			default:
+				return "", err
+			}
+		}
+
+		session.Path = append(parent.Path, parent.ID)
+		session.Depth = len(session.Path)
 		sessionDoc["parent_id"] = parentObjectID
 	}
 
+	sessionDoc["path"] = session.Path
+	sessionDoc["depth"] = session.Depth
+	if session.ForkInstructions != nil {
+		sessionDoc["fork_instructions"] = session.ForkInstructions
+	}
+
 	res, err := m.Collection.InsertOne(ctx, sessionDoc)
 	if err != nil {
 		switch {
@@ -60,14 +141,16 @@ func (m SessionModel) Insert(session *Session) (string, error) {
 	return session.ID.Hex(), nil
 }
 
-func (m SessionModel) GetById(id string) (*Session, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m SessionModel) GetById(ctx context.Context, id string) (*Session, error) {
+	defer observe("SessionModel.GetById")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	var session Session
 	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return nil, ErrRecordNotFound
 	}
 	err = m.Collection.FindOne(ctx, bson.M{"_id": objectId}).Decode(&session)
 	if err != nil {
@@ -82,50 +165,586 @@ func (m SessionModel) GetById(id string) (*Session, error) {
 	return &session, nil
 }
 
-func (m SessionModel) Update(id string, session *Session) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+func (m SessionModel) GetAllForChannel(ctx context.Context, channelId string) ([]*Session, error) {
+	defer observe("SessionModel.GetAllForChannel")()
+
+	objectId, err := primitive.ObjectIDFromHex(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.find(ctx, bson.M{"channel_id": objectId})
+}
+
+func (m SessionModel) GetChildren(ctx context.Context, id string) ([]*Session, error) {
+	defer observe("SessionModel.GetChildren")()
 
 	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return m.find(ctx, bson.M{"parent_id": objectId})
+}
+
+// GetAncestors returns the ancestors of a session ordered from the root down
+// to its parent.
+func (m SessionModel) GetAncestors(ctx context.Context, id string) ([]*Session, error) {
+	defer observe("SessionModel.GetAncestors")()
+
+	session, err := m.GetById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(session.Path) == 0 {
+		return []*Session{}, nil
+	}
+
+	return m.find(ctx, bson.M{"_id": bson.M{"$in": session.Path}})
+}
+
+func (m SessionModel) GetDescendants(ctx context.Context, id string) ([]*Session, error) {
+	defer observe("SessionModel.GetDescendants")()
+
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
 	}
 
+	return m.find(ctx, bson.M{"path": objectId})
+}
+
+func (m SessionModel) GetSiblings(ctx context.Context, id string) ([]*Session, error) {
+	defer observe("SessionModel.GetSiblings")()
+
+	session, err := m.GetById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.ParentId == "" {
+		return []*Session{}, nil
+	}
+
+	parentObjectId, err := primitive.ObjectIDFromHex(session.ParentId)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.find(ctx, bson.M{"parent_id": parentObjectId, "_id": bson.M{"$ne": session.ID}})
+}
+
+func (m SessionModel) Depth(ctx context.Context, id string) (int, error) {
+	defer observe("SessionModel.Depth")()
+
+	session, err := m.GetById(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return session.Depth, nil
+}
+
+// LowestCommonAncestor returns the deepest session that is an ancestor of, or
+// equal to, both sessions. It returns ErrRecordNotFound when the sessions are
+// in different trees.
+func (m SessionModel) LowestCommonAncestor(ctx context.Context, idA, idB string) (*Session, error) {
+	defer observe("SessionModel.LowestCommonAncestor")()
+
+	a, err := m.GetById(ctx, idA)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := m.GetById(ctx, idB)
+	if err != nil {
+		return nil, err
+	}
+
+	chainA := append(append([]primitive.ObjectID{}, a.Path...), a.ID)
+	chainB := append(append([]primitive.ObjectID{}, b.Path...), b.ID)
+
+	var common primitive.ObjectID
+	for i := 0; i < len(chainA) && i < len(chainB) && chainA[i] == chainB[i]; i++ {
+		common = chainA[i]
+	}
+
+	if common.IsZero() {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.GetById(ctx, common.Hex())
+}
+
+// AppendMessages appends message IDs to a session. It fails with
+// ErrEditConflict when the session has changed since it was read.
+func (m SessionModel) AppendMessages(ctx context.Context, session *Session, messageIds []primitive.ObjectID) error {
+	defer observe("SessionModel.AppendMessages")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
 	sessionDoc := bson.M{
 		"$push": bson.M{
 			"messages": bson.M{
-				"$each": session.Messages,
+				"$each": messageIds,
 			},
 		},
+		"$inc": bson.M{
+			"version": 1,
+		},
 	}
 
-	_, err = m.Collection.UpdateOne(ctx, bson.M{"_id": objectId}, sessionDoc)
+	res, err := m.Collection.UpdateOne(ctx, versionFilter(bson.M{"_id": session.ID}, session.Version), sessionDoc)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return ErrRecordNotFound
-		}
 		return err
 	}
 
+	if res.MatchedCount == 0 {
+		return ErrEditConflict
+	}
+
+	session.Messages = append(session.Messages, messageIds...)
+	session.Version++
 	return nil
 }
 
-func (m SessionModel) Delete(id string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// UpdateContext replaces the session's summary, which covers its first
+// compacted messages. It fails with ErrEditConflict when the session has
+// changed since it was read.
+func (m SessionModel) UpdateContext(ctx context.Context, session *Session, summary string, compacted int) error {
+	defer observe("SessionModel.UpdateContext")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	objectId, err := primitive.ObjectIDFromHex(id)
+	sessionDoc := bson.M{
+		"$set": bson.M{
+			"context":   summary,
+			"compacted": compacted,
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+
+	res, err := m.Collection.UpdateOne(ctx, versionFilter(bson.M{"_id": session.ID}, session.Version), sessionDoc)
 	if err != nil {
 		return err
 	}
 
-	_, err = m.Collection.DeleteOne(ctx, bson.M{"_id": objectId})
+	if res.MatchedCount == 0 {
+		return ErrEditConflict
+	}
+
+	session.Context = summary
+	session.Compacted = compacted
+	session.Version++
+	return nil
+}
+
+// UpdateSummary replaces the session's summary, which covers its first
+// count messages. The summary is not part of the conversation, so the
+// version is left alone and only concurrent summary updates conflict.
+func (m SessionModel) UpdateSummary(ctx context.Context, session *Session, summary string, count int) error {
+	defer observe("SessionModel.UpdateSummary")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	sessionDoc := bson.M{
+		"$set": bson.M{
+			"summary":       summary,
+			"summary_count": count,
+		},
+	}
+
+	filter := bson.M{"_id": session.ID, "summary": session.Summary, "summary_count": session.SummaryCount}
+	res, err := m.Collection.UpdateOne(ctx, filter, sessionDoc)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrEditConflict
+	}
+
+	session.Summary = summary
+	session.SummaryCount = count
+	return nil
+}
+
+// UpdateInstructions sets instructions that override the channel's for the
+// session and its descendants. Empty text overrides them with no system
+// prompt at all.
+func (m SessionModel) UpdateInstructions(ctx context.Context, session *Session, text, personaId string) error {
+	defer observe("SessionModel.UpdateInstructions")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := m.Collection.FindOneAndUpdate(ctx, bson.M{"_id": session.ID}, instructionsUpdate(text, personaId), opts).Decode(session)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
 			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClearInstructions removes the session's own instructions, so that it
+// inherits them again.
+func (m SessionModel) ClearInstructions(ctx context.Context, session *Session) error {
+	defer observe("SessionModel.ClearInstructions")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.Collection.UpdateOne(ctx, bson.M{"_id": session.ID}, bson.M{"$unset": bson.M{"instructions": ""}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+
+	session.Instructions = nil
+	return nil
+}
+
+// EffectiveInstructions returns the instructions in effect for a session:
+// its own, those of its nearest ancestor that sets them, or the channel's.
+// It returns nil when none of them have instructions.
+func (m SessionModel) EffectiveInstructions(ctx context.Context, session *Session, channel *Channel) (*EffectiveInstructions, error) {
+	defer observe("SessionModel.EffectiveInstructions")()
+
+	if session.Instructions != nil {
+		return &EffectiveInstructions{Instructions: *session.Instructions, Source: InstructionsSession, SourceId: session.ID.Hex()}, nil
+	}
+
+	if len(session.Path) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+
+		filter := bson.M{"_id": bson.M{"$in": session.Path}, "instructions": bson.M{"$exists": true}}
+		opts := options.FindOne().SetSort(bson.D{{Key: "depth", Value: -1}})
+
+		var ancestor Session
+		err := m.Collection.FindOne(ctx, filter, opts).Decode(&ancestor)
+		switch {
+		case err == nil:
+			return &EffectiveInstructions{Instructions: *ancestor.Instructions, Source: InstructionsSession, SourceId: ancestor.ID.Hex()}, nil
+		case !errors.Is(err, mongo.ErrNoDocuments):
+			return nil, err
 		}
+	}
+
+	if channel.Instructions != nil {
+		return &EffectiveInstructions{Instructions: *channel.Instructions, Source: InstructionsChannel, SourceId: channel.ID.Hex()}, nil
+	}
+
+	return nil, nil
+}
+
+// UpdateGeneration replaces the session's own generation settings. Settings
+// left unset are inherited from its ancestors and channel.
+func (m SessionModel) UpdateGeneration(ctx context.Context, session *Session, cfg llm.GenerationConfig) error {
+	defer observe("SessionModel.UpdateGeneration")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.Collection.UpdateOne(ctx, bson.M{"_id": session.ID}, generationUpdate(cfg))
+	if err != nil {
 		return err
 	}
 
+	if res.MatchedCount == 0 {
+		return ErrRecordNotFound
+	}
+
+	session.Generation = nil
+	if !cfg.IsZero() {
+		session.Generation = &cfg
+	}
 	return nil
 }
+
+// EffectiveGeneration returns the generation settings in effect for a
+// session. Each setting comes from the session itself, its nearest ancestor
+// that sets it, or the channel.
+func (m SessionModel) EffectiveGeneration(ctx context.Context, session *Session, channel *Channel) (llm.GenerationConfig, error) {
+	defer observe("SessionModel.EffectiveGeneration")()
+
+	var cfg llm.GenerationConfig
+	if channel.Generation != nil {
+		cfg = *channel.Generation
+	}
+
+	if len(session.Path) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+
+		filter := bson.M{"_id": bson.M{"$in": session.Path}, "generation": bson.M{"$exists": true}}
+		opts := options.Find().SetSort(bson.D{{Key: "depth", Value: 1}})
+
+		cursor, err := m.Collection.Find(ctx, filter, opts)
+		if err != nil {
+			return llm.GenerationConfig{}, err
+		}
+		defer cursor.Close(ctx)
+
+		var ancestors []Session
+		if err = cursor.All(ctx, &ancestors); err != nil {
+			return llm.GenerationConfig{}, err
+		}
+
+		for _, ancestor := range ancestors {
+			cfg = cfg.Merge(*ancestor.Generation)
+		}
+	}
+
+	if session.Generation != nil {
+		cfg = cfg.Merge(*session.Generation)
+	}
+
+	return cfg, nil
+}
+
+// Delete removes a session. mode decides what happens to child sessions:
+// DeleteRestrict refuses when there are children, DeleteReparent moves them
+// up to the deleted session's parent and DeleteCascade removes the whole
+// subtree. It returns every deleted session, starting with the one asked
+// for. The caller keeps the channel, the tree and the messages consistent.
+func (m SessionModel) Delete(ctx context.Context, id string, mode string) ([]*Session, error) {
+	defer observe("SessionModel.Delete")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	err = m.Collection.FindOne(ctx, bson.M{"_id": objectId}).Decode(&session)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	children, err := m.find(ctx, bson.M{"parent_id": objectId})
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []*Session{&session}
+
+	switch mode {
+	case DeleteRestrict:
+		if len(children) > 0 {
+			return nil, ErrHasChildren
+		}
+	case DeleteReparent:
+		if session.IsRoot && len(children) > 0 {
+			return nil, ErrCannotReparentRoot
+		}
+		if len(children) > 0 {
+			err = m.reparentChildren(ctx, &session)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case DeleteCascade:
+		descendants, err := m.find(ctx, bson.M{"path": objectId})
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, descendants...)
+	default:
+		return nil, ErrInvalidDeleteMode
+	}
+
+	removedIds := make([]primitive.ObjectID, 0, len(removed))
+	for _, s := range removed {
+		removedIds = append(removedIds, s.ID)
+	}
+
+	_, err = m.Collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": removedIds}})
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// reparentChildren moves the children of a session up to its parent and
+// removes the session from the path of every descendant.
+func (m SessionModel) reparentChildren(ctx context.Context, session *Session) error {
+	parentObjectId, err := primitive.ObjectIDFromHex(session.ParentId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Collection.UpdateMany(ctx,
+		bson.M{"path": session.ID},
+		bson.M{
+			"$pull": bson.M{"path": session.ID},
+			"$inc":  bson.M{"depth": -1},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Collection.UpdateMany(ctx,
+		bson.M{"parent_id": session.ID},
+		bson.M{"$set": bson.M{"parent_id": parentObjectId}},
+	)
+	return err
+}
+
+// Unreferenced returns the given messages that no session references any
+// more. Forked sessions share messages, so a deleted session's messages may
+// still be in use.
+func (m SessionModel) Unreferenced(ctx context.Context, ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	defer observe("SessionModel.Unreferenced")()
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	opts := options.Find().SetProjection(bson.M{"messages": 1})
+	cursor, err := m.Collection.Find(ctx, bson.M{"messages": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	referenced := make(map[primitive.ObjectID]bool)
+	for cursor.Next(ctx) {
+		var s Session
+		if err := cursor.Decode(&s); err != nil {
+			return nil, err
+		}
+		for _, messageId := range s.Messages {
+			referenced[messageId] = true
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	unreferenced := []primitive.ObjectID{}
+	for _, id := range ids {
+		if !referenced[id] {
+			unreferenced = append(unreferenced, id)
+		}
+	}
+
+	return unreferenced, nil
+}
+
+// SetPath records the place in the tree of a session created before
+// sessions carried it, given the hex IDs of its parent and of its ancestors
+// from the root down. Sessions that already have a path are left alone. It
+// reports whether the session was updated.
+func (m SessionModel) SetPath(ctx context.Context, id, parentId string, ancestors []string) (bool, error) {
+	defer observe("SessionModel.SetPath")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, err
+	}
+
+	path := make([]primitive.ObjectID, 0, len(ancestors))
+	for _, ancestor := range ancestors {
+		ancestorID, err := primitive.ObjectIDFromHex(ancestor)
+		if err != nil {
+			return false, err
+		}
+		path = append(path, ancestorID)
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"path":    path,
+			"depth":   len(path),
+			"is_root": parentId == "",
+		},
+	}
+	if parentId == "" {
+		update["$unset"] = bson.M{"parent_id": ""}
+	} else {
+		parentObjectID, err := primitive.ObjectIDFromHex(parentId)
+		if err != nil {
+			return false, err
+		}
+		update["$set"].(bson.M)["parent_id"] = parentObjectID
+	}
+
+	res, err := m.Collection.UpdateOne(ctx, bson.M{"_id": objectID, "path": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount > 0, nil
+}
+
+// SetMissingRootPaths gives root sessions created before sessions carried
+// their place in the tree an empty path. It returns the number of sessions
+// updated.
+func (m SessionModel) SetMissingRootPaths(ctx context.Context) (int, error) {
+	defer observe("SessionModel.SetMissingRootPaths")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	filter := bson.M{"is_root": true, "path": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"path": bson.A{}, "depth": 0}}
+
+	res, err := m.Collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.ModifiedCount), nil
+}
+
+func (m SessionModel) find(ctx context.Context, filter bson.M) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "depth", Value: 1}, {Key: "created_at", Value: 1}})
+
+	cursor, err := m.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []*Session{}
+	if err = cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
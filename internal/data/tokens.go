@@ -5,11 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"misc.sahilsasane.net/internal/validator"
 )
 
@@ -17,10 +19,14 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
+// Token is an opaque token stored by its hash. Access tokens are JWTs, so
+// for them the hash is taken over the JWT ID (jti) instead; they are only
+// recorded so that every outstanding access token of a user can be revoked.
 type Token struct {
-	Plaintext string             `json:"token" bson:"plaintext"`
+	Plaintext string             `json:"token" bson:"-"`
 	Hash      []byte             `json:"-" bson:"hash"`
 	UserID    primitive.ObjectID `json:"-" bson:"user_id"`
 	Expiry    time.Time          `json:"expiry" bson:"expiry"`
@@ -56,29 +62,204 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 type TokenModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
 }
 
-func (m TokenModel) New(userID primitive.ObjectID, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	// Expired tokens and denylist entries are removed by MongoDB.
+	ttlIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiry", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	hashIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "hash", Value: 1}},
+	}
+
+	_, err := m.Collection.Indexes().CreateMany(ctx, []mongo.IndexModel{ttlIndex, hashIndex})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.denylist().Indexes().CreateMany(ctx, []mongo.IndexModel{ttlIndex, hashIndex})
+	return err
+}
+
+func (m TokenModel) New(ctx context.Context, userID primitive.ObjectID, ttl time.Duration, scope string) (*Token, error) {
+	defer observe("TokenModel.New")()
+
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	defer observe("TokenModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.Collection.InsertOne(ctx, token)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID primitive.ObjectID) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID primitive.ObjectID) error {
+	defer observe("TokenModel.DeleteAllForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 	_, err := m.Collection.DeleteMany(ctx, bson.M{"scope": scope, "user_id": userID})
 	return err
 }
+
+// Consume deletes a valid token and returns it, so that each token can only
+// be used once even under concurrent requests.
+func (m TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	defer observe("TokenModel.Consume")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	var token Token
+	err := m.Collection.FindOneAndDelete(ctx, bson.M{
+		"hash":   tokenHash[:],
+		"scope":  scope,
+		"expiry": bson.M{"$gt": time.Now()},
+	}).Decode(&token)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// DeleteForToken removes a single token belonging to the user.
+func (m TokenModel) DeleteForToken(ctx context.Context, scope, tokenPlaintext string, userID primitive.ObjectID) error {
+	defer observe("TokenModel.DeleteForToken")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	_, err := m.Collection.DeleteOne(ctx, bson.M{"hash": tokenHash[:], "scope": scope, "user_id": userID})
+	return err
+}
+
+// TrackAccessToken records an issued access token by its JWT ID.
+func (m TokenModel) TrackAccessToken(ctx context.Context, userID primitive.ObjectID, jti string, expiry time.Time) error {
+	defer observe("TokenModel.TrackAccessToken")()
+
+	hash := sha256.Sum256([]byte(jti))
+
+	return m.Insert(ctx, &Token{
+		Hash:   hash[:],
+		UserID: userID,
+		Expiry: expiry,
+		Scope:  ScopeAuthentication,
+	})
+}
+
+// Revoke adds an access token to the denylist until it would have expired
+// anyway.
+func (m TokenModel) Revoke(ctx context.Context, jti string, userID primitive.ObjectID, expiry time.Time) error {
+	defer observe("TokenModel.Revoke")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(jti))
+
+	_, err := m.denylist().InsertOne(ctx, bson.M{
+		"hash":    hash[:],
+		"user_id": userID,
+		"expiry":  expiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Collection.DeleteOne(ctx, bson.M{"hash": hash[:], "scope": ScopeAuthentication})
+	return err
+}
+
+// RevokeAllForUser denylists every outstanding access token of the user and
+// deletes all of their refresh tokens.
+func (m TokenModel) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID) error {
+	defer observe("TokenModel.RevokeAllForUser")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	filter := bson.M{
+		"scope":   ScopeAuthentication,
+		"user_id": userID,
+		"expiry":  bson.M{"$gt": time.Now()},
+	}
+
+	cursor, err := m.Collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []*Token
+	if err = cursor.All(ctx, &tokens); err != nil {
+		return err
+	}
+
+	if len(tokens) > 0 {
+		entries := make([]interface{}, 0, len(tokens))
+		for _, token := range tokens {
+			entries = append(entries, bson.M{
+				"hash":    token.Hash,
+				"user_id": token.UserID,
+				"expiry":  token.Expiry,
+			})
+		}
+
+		_, err = m.denylist().InsertMany(ctx, entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = m.Collection.DeleteMany(ctx, bson.M{
+		"user_id": userID,
+		"scope":   bson.M{"$in": []string{ScopeAuthentication, ScopeRefresh}},
+	})
+	return err
+}
+
+func (m TokenModel) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	defer observe("TokenModel.IsRevoked")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(jti))
+
+	count, err := m.denylist().CountDocuments(ctx, bson.M{"hash": hash[:]}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (m TokenModel) denylist() *mongo.Collection {
+	return m.Collection.Database().Collection("revoked_tokens")
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"misc.sahilsasane.net/internal/validator"
+)
+
+func TestGenerateToken(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	token, err := generateToken(userID, time.Hour, ScopeRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := validator.New()
+	if ValidateTokenPlaintext(v, token.Plaintext); !v.Valid() {
+		t.Errorf("plaintext %q fails validation: %v", token.Plaintext, v.Errors)
+	}
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	if !bytes.Equal(token.Hash, hash[:]) {
+		t.Error("hash is not the SHA-256 of the plaintext")
+	}
+
+	if token.UserID != userID || token.Scope != ScopeRefresh {
+		t.Errorf("got user %v, scope %q; want %v, %q", token.UserID, token.Scope, userID, ScopeRefresh)
+	}
+	if until := time.Until(token.Expiry); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("got expiry in %v; want in an hour", until)
+	}
+
+	other, err := generateToken(userID, time.Hour, ScopeRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Plaintext == token.Plaintext {
+		t.Error("two tokens share a plaintext")
+	}
+}
+
+func TestValidateTokenPlaintext(t *testing.T) {
+	tests := map[string]bool{
+		"":                            false,
+		"ABCDEFGHIJKLMNOPQRSTUVWXY":   false,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ":  true,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ2": false,
+	}
+
+	for plaintext, valid := range tests {
+		v := validator.New()
+		ValidateTokenPlaintext(v, plaintext)
+
+		if v.Valid() != valid {
+			t.Errorf("%q: got valid %v; want %v", plaintext, v.Valid(), valid)
+		}
+	}
+}
@@ -9,21 +9,68 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Tree records the root of a channel's conversation tree. The structure
+// itself lives on the session documents (parent_id, path and depth) and is
+// assembled with BuildTree. Version is bumped on every structural change.
 type Tree struct {
-	ID            primitive.ObjectID     `json:"id" bson:"_id"`
-	ChannelId     string                 `json:"channel_id" bson:"channel_id"`
-	Root          string                 `json:"root" bson:"root"`
-	CreatedAt     time.Time              `json:"created_at" bson:"created_at"`
-	UpdatedAt     time.Time              `json:"updated_at" bson:"updated_at"`
-	TreeStructure map[string]interface{} `json:"tree" bson:"tree"`
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	ChannelId string             `json:"channel_id" bson:"channel_id"`
+	Root      string             `json:"root" bson:"root"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+	Version   int                `json:"version" bson:"version"`
+}
+
+// TreeNode is a session and its metadata as shown in a tree view.
+type TreeNode struct {
+	SessionId    string      `json:"session_id"`
+	ParentId     string      `json:"parent_id,omitempty"`
+	Depth        int         `json:"depth"`
+	MessageCount int         `json:"message_count"`
+	Summary      string      `json:"summary,omitempty"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Children     []*TreeNode `json:"children"`
+}
+
+// BuildTree assembles sessions into nested nodes and returns the top-level
+// nodes. Sessions whose parent is not in the list are treated as roots.
+func BuildTree(sessions []*Session) []*TreeNode {
+	nodes := make(map[string]*TreeNode, len(sessions))
+	for _, session := range sessions {
+		nodes[session.ID.Hex()] = &TreeNode{
+			SessionId:    session.ID.Hex(),
+			ParentId:     session.ParentId,
+			Depth:        session.Depth,
+			MessageCount: len(session.Messages),
+			Summary:      session.Summary,
+			CreatedAt:    session.CreatedAt,
+			Children:     []*TreeNode{},
+		}
+	}
+
+	roots := []*TreeNode{}
+	for _, session := range sessions {
+		node := nodes[session.ID.Hex()]
+		parent, ok := nodes[session.ParentId]
+		if session.ParentId == "" || !ok {
+			roots = append(roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+
+	return roots
 }
 
 type TreeModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
 }
 
-func (m TreeModel) Insert(tree *Tree) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m TreeModel) Insert(ctx context.Context, tree *Tree) (string, error) {
+	defer observe("TreeModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	channelObjectID, err := primitive.ObjectIDFromHex(tree.ChannelId)
@@ -40,12 +87,14 @@ func (m TreeModel) Insert(tree *Tree) (string, error) {
 		}
 	}
 
+	tree.Version = 1
+
 	treeDoc := bson.M{
 		"channel_id": channelObjectID,
 		"root":       rootValue,
-		"tree":       tree.TreeStructure,
 		"created_at": time.Now(),
 		"updated_at": time.Now(),
+		"version":    tree.Version,
 	}
 
 	res, err := m.Collection.InsertOne(ctx, treeDoc)
@@ -53,7 +102,7 @@ func (m TreeModel) Insert(tree *Tree) (string, error) {
 	if err != nil {
 		switch {
 		case mongo.IsDuplicateKeyError(err):
-			return "", ErrDuplicateEmail
+			return "", ErrCannotInsert
 		default:
 			return "", err
 		}
@@ -63,8 +112,10 @@ func (m TreeModel) Insert(tree *Tree) (string, error) {
 	return tree.ID.Hex(), nil
 }
 
-func (m TreeModel) GetByChannelId(id string) (*Tree, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m TreeModel) GetByChannelId(ctx context.Context, id string) (*Tree, error) {
+	defer observe("TreeModel.GetByChannelId")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	var tree Tree
@@ -83,8 +134,12 @@ func (m TreeModel) GetByChannelId(id string) (*Tree, error) {
 	return &tree, nil
 }
 
-func (m TreeModel) Update(id string, tree *Tree) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Update records a structural change to the tree. It fails with
+// ErrEditConflict when the tree has changed since it was read.
+func (m TreeModel) Update(ctx context.Context, id string, tree *Tree) error {
+	defer observe("TreeModel.Update")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	objectID, err := primitive.ObjectIDFromHex(id)
@@ -94,7 +149,9 @@ func (m TreeModel) Update(id string, tree *Tree) error {
 	treeDoc := bson.M{
 		"$set": bson.M{
 			"updated_at": time.Now(),
-			"tree":       tree.TreeStructure,
+		},
+		"$inc": bson.M{
+			"version": 1,
 		},
 	}
 
@@ -106,12 +163,87 @@ func (m TreeModel) Update(id string, tree *Tree) error {
 		treeDoc["$set"].(bson.M)["root"] = rootObjectId
 	}
 
-	err = m.Collection.FindOneAndUpdate(ctx, bson.M{"channel_id": objectID}, treeDoc).Err()
+	filter := versionFilter(bson.M{"channel_id": objectID}, tree.Version)
+
+	err = m.Collection.FindOneAndUpdate(ctx, filter, treeDoc).Err()
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return ErrRecordNotFound
+			return ErrEditConflict
 		}
 		return err
 	}
+
+	tree.Version++
 	return nil
 }
+
+// RecordDeletion bumps the version of a channel's tree after sessions were
+// deleted from it, clearing its root when the root was among them.
+func (m TreeModel) RecordDeletion(ctx context.Context, channelId string, rootDeleted bool) error {
+	defer observe("TreeModel.RecordDeletion")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(channelId)
+	if err != nil {
+		return err
+	}
+
+	treeDoc := bson.M{
+		"$set": bson.M{"updated_at": time.Now()},
+		"$inc": bson.M{"version": 1},
+	}
+	if rootDeleted {
+		treeDoc["$set"].(bson.M)["root"] = nil
+	}
+
+	_, err = m.Collection.UpdateOne(ctx, bson.M{"channel_id": objectID}, treeDoc)
+	return err
+}
+
+// legacyTreeNode is a session in the nested structure that trees held
+// before sessions carried their own place in the tree.
+type legacyTreeNode struct {
+	Root     string           `bson:"root"`
+	Children []legacyTreeNode `bson:"children"`
+}
+
+// legacyTree is a tree document that still holds a nested structure.
+type legacyTree struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Structure legacyTreeNode     `bson:"tree"`
+}
+
+// GetLegacy returns the trees that still hold a nested structure.
+func (m TreeModel) GetLegacy(ctx context.Context) ([]legacyTree, error) {
+	defer observe("TreeModel.GetLegacy")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	cursor, err := m.Collection.Find(ctx, bson.M{"tree": bson.M{"$type": "object"}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	trees := []legacyTree{}
+	if err = cursor.All(ctx, &trees); err != nil {
+		return nil, err
+	}
+
+	return trees, nil
+}
+
+// ClearLegacy removes the nested structure of a tree once it has been
+// migrated.
+func (m TreeModel) ClearLegacy(ctx context.Context, id primitive.ObjectID) error {
+	defer observe("TreeModel.ClearLegacy")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.Collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"tree": ""}})
+	return err
+}
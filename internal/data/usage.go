@@ -0,0 +1,100 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage is the number of LLM tokens a user has consumed on a UTC day.
+type Usage struct {
+	UserID primitive.ObjectID `json:"-" bson:"user_id"`
+	Day    string             `json:"day" bson:"day"`
+	Tokens int                `json:"tokens" bson:"tokens"`
+	Expiry time.Time          `json:"-" bson:"expiry"`
+}
+
+type UsageModel struct {
+	Collection *mongo.Collection
+	Timeout    time.Duration
+}
+
+func (m UsageModel) CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.Collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "day", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// Old days are only needed until they can no longer be current.
+			Keys:    bson.D{{Key: "expiry", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+
+	return err
+}
+
+// UsageDay returns the key of the UTC day containing t.
+func UsageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// GetTokens returns the number of tokens the user has consumed on day.
+func (m UsageModel) GetTokens(ctx context.Context, userID primitive.ObjectID, day string) (int, error) {
+	defer observe("UsageModel.GetTokens")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var usage Usage
+	err := m.Collection.FindOne(ctx, bson.M{"user_id": userID, "day": day}).Decode(&usage)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	return usage.Tokens, nil
+}
+
+// AddTokens adds to the user's usage for day and returns the new total.
+func (m UsageModel) AddTokens(ctx context.Context, userID primitive.ObjectID, day string, tokens int) (int, error) {
+	defer observe("UsageModel.AddTokens")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	start, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var usage Usage
+	err = m.Collection.FindOneAndUpdate(ctx,
+		bson.M{"user_id": userID, "day": day},
+		bson.M{
+			"$inc":         bson.M{"tokens": tokens},
+			"$setOnInsert": bson.M{"expiry": start.Add(48 * time.Hour)},
+		},
+		opts,
+	).Decode(&usage)
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.Tokens, nil
+}
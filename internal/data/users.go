@@ -89,10 +89,13 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 type UserModel struct {
 	Collection *mongo.Collection
+	Timeout    time.Duration
 }
 
-func (m UserModel) Insert(user *User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	defer observe("UserModel.Insert")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	user.CreatedAt = time.Now()
@@ -122,10 +125,12 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	defer observe("UserModel.GetByEmail")()
+
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.Collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
@@ -143,22 +148,30 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Update writes the user back, including the current password hash. It fails
+// with ErrEditConflict when the user has changed since it was read.
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	defer observe("UserModel.Update")()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
+	channels := user.Channels
+	if channels == nil {
+		channels = []primitive.ObjectID{}
+	}
+
 	result := m.Collection.FindOneAndUpdate(
 		ctx,
-		bson.M{"_id": user.ID},
+		bson.M{"_id": user.ID, "version": user.Version},
 		bson.M{
 			"$set": bson.M{
-				"name":      user.Name,
-				"email":     user.Email,
-				"activated": user.Activated,
-				"version":   user.Version + 1,
-			},
-			"$push": bson.M{
-				"channels": user.Channels,
+				"name":          user.Name,
+				"email":         user.Email,
+				"password_hash": user.Password.hash,
+				"channels":      channels,
+				"activated":     user.Activated,
+				"version":       user.Version + 1,
 			},
 		},
 	)
@@ -174,13 +187,17 @@ func (m UserModel) Update(user *User) error {
 		}
 	}
 
+	user.PasswordHash = user.Password.hash
+	user.Version++
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	defer observe("UserModel.GetForToken")()
+
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// First find the token
@@ -212,13 +229,17 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 
+	user.Password.hash = user.PasswordHash
+
 	return &user, nil
 }
 
-func (m UserModel) Get(id primitive.ObjectID) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	defer observe("UserModel.Get")()
+
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.Collection.FindOne(ctx, bson.M{"_id": primitive.ObjectID(id)}).Decode(&user)
@@ -232,11 +253,13 @@ func (m UserModel) Get(id primitive.ObjectID) (*User, error) {
 		}
 	}
 
+	user.Password.hash = user.PasswordHash
+
 	return &user, nil
 }
 
 func (m UserModel) CreateIndexes() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
 	defer cancel()
 
 	_, err := m.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
@@ -0,0 +1,318 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const anthropicVersion = "2023-06-01"
+
+type AnthropicClient struct {
+	APIKey    string
+	Model     string
+	BaseURL   string
+	MaxTokens int
+	Timeout   time.Duration
+}
+
+func NewAnthropicClient(apiKey, model, baseURL string) *AnthropicClient {
+	if model == "" {
+		model = "claude-3-5-haiku-latest"
+	}
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com/v1"
+	}
+	return &AnthropicClient{
+		APIKey:    apiKey,
+		Model:     model,
+		BaseURL:   strings.TrimSuffix(baseURL, "/"),
+		MaxTokens: 4096,
+		Timeout:   defaultTimeout,
+	}
+}
+
+type AnthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicStreamEvent covers the events that carry text or usage. The
+// input token count arrives in message_start and the output token count in
+// message_delta.
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func anthropicFinishErr(reason string) error {
+	switch reason {
+	case "refusal":
+		return finishError(ProviderAnthropic, ErrBlocked, reason)
+	case "max_tokens":
+		return finishError(ProviderAnthropic, ErrTruncated, reason)
+	default:
+		return nil
+	}
+}
+
+// anthropicStreamErr classifies an error event sent in the middle of a
+// stream, after the response status has already been sent.
+func anthropicStreamErr(errorType string) error {
+	switch errorType {
+	case "overloaded_error", "api_error":
+		return ErrUnavailable
+	case "rate_limit_error":
+		return ErrRateLimited
+	case "authentication_error", "permission_error":
+		return ErrAuth
+	default:
+		return ErrBadRequest
+	}
+}
+
+func (a *AnthropicClient) Name() string {
+	return ProviderAnthropic
+}
+
+func (a *AnthropicClient) DefaultModel() string {
+	return a.Model
+}
+
+func (a *AnthropicClient) GenerateContent(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	payload, err := a.payload(messages, opts, false)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+
+	resp, err := postJSON(ctx, a.BaseURL+"/messages", a.headers(), payload)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(ProviderAnthropic, resp); err != nil {
+		return nil, Usage{}, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+
+	var anthropicRes AnthropicResponse
+	if err := json.Unmarshal(body, &anthropicRes); err != nil {
+		return nil, Usage{}, err
+	}
+
+	usage := Usage{
+		InputTokens:  anthropicRes.Usage.InputTokens,
+		OutputTokens: anthropicRes.Usage.OutputTokens,
+	}
+
+	texts := []string{}
+	for _, block := range anthropicRes.Content {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+
+	text := strings.Join(texts, "")
+	if err := anthropicFinishErr(anthropicRes.StopReason); err != nil {
+		return []string{text}, usage, err
+	}
+
+	if text != "" {
+		return []string{text}, usage, nil
+	}
+
+	return nil, usage, ErrNoResponse
+}
+
+func (a *AnthropicClient) StreamContent(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	payload, err := a.payload(messages, opts, true)
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	resp, err := postJSON(ctx, a.BaseURL+"/messages", a.headers(), payload)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(ProviderAnthropic, resp); err != nil {
+		return "", Usage{}, err
+	}
+
+	var sb strings.Builder
+	var usage Usage
+	var finishErr error
+	err = readEvents(resp.Body, func(data []byte) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage.InputTokens = event.Message.Usage.InputTokens
+		case "message_delta":
+			usage.OutputTokens = event.Usage.OutputTokens
+			finishErr = anthropicFinishErr(event.Delta.StopReason)
+		case "error":
+			return &APIError{Provider: ProviderAnthropic, Message: event.Error.Message, Err: anthropicStreamErr(event.Error.Type)}
+		}
+
+		if event.Type != "content_block_delta" || event.Delta.Type != "text_delta" {
+			return nil
+		}
+
+		sb.WriteString(event.Delta.Text)
+		return fn(event.Delta.Text)
+	})
+	if err != nil {
+		return sb.String(), usage, err
+	}
+
+	if finishErr != nil {
+		return sb.String(), usage, finishErr
+	}
+
+	if sb.Len() == 0 {
+		return "", usage, ErrNoResponse
+	}
+
+	return sb.String(), usage, nil
+}
+
+func (a *AnthropicClient) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         a.APIKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
+
+// payload builds a messages request. The API always generates a single
+// candidate.
+func (a *AnthropicClient) payload(messages []Data, opts Options, stream bool) (map[string]interface{}, error) {
+	gen := opts.Generation
+	if gen.candidates() > 1 {
+		return nil, fmt.Errorf("%w: candidate_count", ErrUnsupportedSetting)
+	}
+
+	anthropicMessages, err := toAnthropicMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	model, maxTokens := a.Model, a.MaxTokens
+	if gen.Model != "" {
+		model = gen.Model
+	}
+	if gen.MaxOutputTokens != nil {
+		maxTokens = *gen.MaxOutputTokens
+	}
+
+	payload := map[string]interface{}{
+		"model":      model,
+		"max_tokens": maxTokens,
+		"messages":   anthropicMessages,
+		"stream":     stream,
+	}
+	if opts.System != "" {
+		payload["system"] = opts.System
+	}
+	if gen.Temperature != nil {
+		payload["temperature"] = *gen.Temperature
+	}
+	if gen.TopP != nil {
+		payload["top_p"] = *gen.TopP
+	}
+	if gen.TopK != nil {
+		payload["top_k"] = *gen.TopK
+	}
+	if len(gen.StopSequences) > 0 {
+		payload["stop_sequences"] = gen.StopSequences
+	}
+	return payload, nil
+}
+
+// toAnthropicMessages converts messages to the messages API format, which
+// uses the same role names and plain string content as OpenAI. Messages
+// with attachments are sent as content blocks.
+func toAnthropicMessages(messages []Data) ([]openAIRequestMessage, error) {
+	err := checkParts(messages, portableMimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]openAIRequestMessage, 0, len(messages))
+	for _, msg := range messages {
+		role := msg.Role
+		if role == "model" {
+			role = "assistant"
+		}
+
+		if !hasInlineData(msg) {
+			result = append(result, openAIRequestMessage{Role: role, Content: msg.Text()})
+			continue
+		}
+
+		content := []map[string]interface{}{}
+		for _, part := range msg.Parts {
+			switch {
+			case part.InlineData == nil:
+				content = append(content, map[string]interface{}{"type": "text", "text": part.Text})
+			case part.InlineData.MimeType == "text/plain":
+				content = append(content, map[string]interface{}{"type": "text", "text": string(part.InlineData.Data)})
+			default:
+				blockType := "image"
+				if part.InlineData.MimeType == "application/pdf" {
+					blockType = "document"
+				}
+				content = append(content, map[string]interface{}{
+					"type": blockType,
+					"source": map[string]string{
+						"type":       "base64",
+						"media_type": part.InlineData.MimeType,
+						"data":       base64.StdEncoding.EncodeToString(part.InlineData.Data),
+					},
+				})
+			}
+		}
+		result = append(result, openAIRequestMessage{Role: role, Content: content})
+	}
+	return result, nil
+}
@@ -0,0 +1,181 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Compaction strategies decide what is sent to the model once a history
+// no longer fits in its context window.
+const (
+	// CompactWindow drops the oldest turns.
+	CompactWindow = "window"
+	// CompactSummarize replaces the oldest turns with a summary.
+	CompactSummarize = "summarize"
+	// CompactFirstLast keeps the opening turns and the most recent ones.
+	CompactFirstLast = "first-last"
+)
+
+const (
+	// messageOverhead approximates the tokens a provider spends on the role
+	// and framing of each message.
+	messageOverhead = 4
+	// attachmentTokens approximates the tokens of an image or a document
+	// page.
+	attachmentTokens = 258
+)
+
+// EstimateTokens approximates the prompt size of messages at four
+// characters per token, plus a fixed amount for each attachment.
+func EstimateTokens(messages []Data) int {
+	tokens := 0
+	for _, msg := range messages {
+		tokens += (len(msg.Text())+3)/4 + messageOverhead
+		for _, part := range msg.Parts {
+			if part.InlineData != nil || part.File != nil {
+				tokens += attachmentTokens
+			}
+		}
+	}
+	return tokens
+}
+
+// Window returns the longest suffix of messages that fits in maxTokens and
+// starts with a user turn. The last turn is always kept, even if it does
+// not fit on its own.
+func Window(messages []Data, maxTokens int) []Data {
+	if len(messages) == 0 {
+		return messages
+	}
+
+	start := len(messages) - 1
+	tokens := EstimateTokens(messages[start:])
+	for start > 0 {
+		next := EstimateTokens(messages[start-1 : start])
+		if tokens+next > maxTokens {
+			break
+		}
+		tokens += next
+		start--
+	}
+
+	return messages[turnStart(messages, start):]
+}
+
+// FirstLast keeps the first first messages and as many of the last last
+// messages as fit in maxTokens. When the opening messages alone do not fit
+// it falls back to Window.
+func FirstLast(messages []Data, first, last, maxTokens int) []Data {
+	if len(messages) <= first+last && EstimateTokens(messages) <= maxTokens {
+		return messages
+	}
+
+	// Cut the head before a user turn so that the kept history still
+	// alternates.
+	first = min(first, len(messages)-1)
+	for first > 0 && messages[first].Role != "user" {
+		first--
+	}
+	head := messages[:first]
+
+	budget := maxTokens - EstimateTokens(head)
+	if first == 0 || budget <= 0 {
+		return Window(messages, maxTokens)
+	}
+
+	rest := messages[first:]
+	tail := Window(rest[max(0, len(rest)-last):], budget)
+
+	history := make([]Data, 0, len(head)+len(tail))
+	history = append(history, head...)
+	return append(history, tail...)
+}
+
+// WithSummary returns messages preceded by an exchange carrying summary, so
+// the model can refer to turns that are no longer sent.
+func WithSummary(summary string, messages []Data) []Data {
+	if summary == "" {
+		return messages
+	}
+
+	history := []Data{
+		{Role: "user", Parts: []Part{TextPart("Summary of our conversation so far:\n\n" + summary)}},
+		{Role: "model", Parts: []Part{TextPart("Understood. I will continue the conversation from that summary.")}},
+	}
+	return append(history, messages...)
+}
+
+// SummaryCut returns the index, after from, at which the last keep messages
+// begin, moved back to the start of a turn. It returns from when there is
+// nothing to summarize.
+func SummaryCut(messages []Data, from, keep int) int {
+	cut := len(messages) - keep
+	for cut > from && messages[cut].Role != "user" {
+		cut--
+	}
+	return max(cut, from)
+}
+
+const (
+	summaryPrompt = `Summarize the conversation below so that it can be continued without the original messages. Keep every fact, decision, name, number and open question that later turns may depend on, and note who said what where it matters. Reply with the summary only.`
+
+	chatSummaryPrompt = `Summarize what the conversation below explored in two or three sentences, so that someone browsing a list of conversations can tell what this one covered and where it ended up. Reply with the summary only.`
+)
+
+// Summarize condenses messages, together with the summary of the turns
+// before them, into a new summary that can stand in for them in the
+// history. opts should be those of the conversation, so that the summary is
+// written by the same model under the same instructions. A summary cut off
+// at the token limit is still returned along with ErrTruncated.
+func (c *ChatSession) Summarize(ctx context.Context, summary string, messages []Data, opts Options) (string, Usage, error) {
+	return c.summarize(ctx, summaryPrompt, summary, messages, opts)
+}
+
+// GetChatSummary writes a short summary of a conversation for people rather
+// than the model. Passing the previous summary and only the messages since
+// refreshes it incrementally.
+func (c *ChatSession) GetChatSummary(ctx context.Context, summary string, messages []Data, opts Options) (string, Usage, error) {
+	return c.summarize(ctx, chatSummaryPrompt, summary, messages, opts)
+}
+
+func (c *ChatSession) summarize(ctx context.Context, instruction, summary string, messages []Data, opts Options) (string, Usage, error) {
+	var transcript strings.Builder
+	if summary != "" {
+		transcript.WriteString("Summary of the earlier conversation:\n")
+		transcript.WriteString(summary)
+		transcript.WriteString("\n\n")
+	}
+	for _, msg := range messages {
+		transcript.WriteString(msg.Role)
+		transcript.WriteString(": ")
+		transcript.WriteString(msg.Text())
+		transcript.WriteString("\n\n")
+	}
+
+	prompt := []Data{
+		{Role: "user", Parts: []Part{TextPart(instruction + "\n\n" + transcript.String())}},
+	}
+
+	// A summary takes a single candidate, whatever the conversation asks for.
+	opts.Generation.CandidateCount = nil
+
+	var text string
+	candidates, usage, err := c.generate(ctx, "summarize", prompt, opts)
+	if len(candidates) > 0 {
+		text = candidates[0]
+	}
+	if err != nil && !(errors.Is(err, ErrTruncated) && text != "") {
+		return "", usage, err
+	}
+	return strings.TrimSpace(text), usage, err
+}
+
+// turnStart moves i forward to the next user message, leaving at least the
+// last message.
+func turnStart(messages []Data, i int) int {
+	for i < len(messages)-1 && messages[i].Role != "user" {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,354 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// conversation returns n alternating user and model messages, starting with
+// a user one. Each is estimated at 8 tokens.
+func conversation(n int) []Data {
+	messages := make([]Data, n)
+	for i := range messages {
+		role := "user"
+		if i%2 == 1 {
+			role = "model"
+		}
+		messages[i] = Data{Role: role, Parts: []Part{TextPart(fmt.Sprintf("message %8d", i))}}
+	}
+	return messages
+}
+
+// positions returns the index each message had in conversation.
+func positions(t *testing.T, messages []Data) []int {
+	t.Helper()
+
+	got := make([]int, len(messages))
+	for i, msg := range messages {
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(msg.Text(), "message")))
+		if err != nil {
+			t.Fatalf("message %d is not from conversation: %q", i, msg.Text())
+		}
+		got[i] = n
+	}
+	return got
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Data
+		want     int
+	}{
+		{
+			name: "no messages",
+			want: 0,
+		},
+		{
+			name:     "empty message",
+			messages: []Data{{Role: "user"}},
+			want:     messageOverhead,
+		},
+		{
+			name:     "rounds up",
+			messages: []Data{{Role: "user", Parts: []Part{TextPart("hello")}}},
+			want:     2 + messageOverhead,
+		},
+		{
+			name:     "joins text parts",
+			messages: []Data{{Role: "user", Parts: []Part{TextPart("ab"), TextPart("cd")}}},
+			want:     2 + messageOverhead,
+		},
+		{
+			name: "counts attachments",
+			messages: []Data{{Role: "user", Parts: []Part{
+				{InlineData: &InlineData{MimeType: "image/png"}},
+				{File: &File{}},
+			}}},
+			want: 2*attachmentTokens + messageOverhead,
+		},
+		{
+			name:     "sums messages",
+			messages: conversation(3),
+			want:     24,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateTokens(tt.messages); got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		n         int
+		maxTokens int
+		want      []int
+	}{
+		{
+			name:      "no messages",
+			n:         0,
+			maxTokens: 100,
+			want:      []int{},
+		},
+		{
+			name:      "everything fits",
+			n:         6,
+			maxTokens: 48,
+			want:      []int{0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:      "starts with a user turn",
+			n:         6,
+			maxTokens: 24,
+			want:      []int{4, 5},
+		},
+		{
+			name:      "keeps the last message",
+			n:         6,
+			maxTokens: 0,
+			want:      []int{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := positions(t, Window(conversation(tt.n), tt.maxTokens))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	tests := []struct {
+		name        string
+		n           int
+		first, last int
+		maxTokens   int
+		want        []int
+	}{
+		{
+			name:      "everything fits",
+			n:         6,
+			first:     2,
+			last:      4,
+			maxTokens: 48,
+			want:      []int{0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:      "drops the middle",
+			n:         6,
+			first:     2,
+			last:      2,
+			maxTokens: 48,
+			want:      []int{0, 1, 4, 5},
+		},
+		{
+			name:      "cuts the head before a user turn",
+			n:         6,
+			first:     3,
+			last:      2,
+			maxTokens: 48,
+			want:      []int{0, 1, 4, 5},
+		},
+		{
+			name:      "tail limited by tokens",
+			n:         6,
+			first:     2,
+			last:      4,
+			maxTokens: 40,
+			want:      []int{0, 1, 4, 5},
+		},
+		{
+			name:      "head does not fit",
+			n:         6,
+			first:     2,
+			last:      2,
+			maxTokens: 16,
+			want:      []int{4, 5},
+		},
+		{
+			name:      "no head",
+			n:         6,
+			first:     0,
+			last:      2,
+			maxTokens: 16,
+			want:      []int{4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := positions(t, FirstLast(conversation(tt.n), tt.first, tt.last, tt.maxTokens))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithSummary(t *testing.T) {
+	messages := conversation(2)
+
+	if got := WithSummary("", messages); len(got) != len(messages) {
+		t.Errorf("empty summary: got %d messages; want %d", len(got), len(messages))
+	}
+
+	got := WithSummary("earlier turns", messages)
+	if len(got) != len(messages)+2 {
+		t.Fatalf("got %d messages; want %d", len(got), len(messages)+2)
+	}
+	if got[0].Role != "user" || got[1].Role != "model" {
+		t.Errorf("got roles %q, %q; want user, model", got[0].Role, got[1].Role)
+	}
+	if !strings.Contains(got[0].Text(), "earlier turns") {
+		t.Errorf("summary missing from %q", got[0].Text())
+	}
+	if !slices.Equal(positions(t, got[2:]), []int{0, 1}) {
+		t.Errorf("messages not kept after the summary")
+	}
+}
+
+func TestSummaryCut(t *testing.T) {
+	tests := []struct {
+		name string
+		from int
+		keep int
+		want int
+	}{
+		{name: "cut at a user turn", from: 0, keep: 2, want: 4},
+		{name: "moves back to a user turn", from: 0, keep: 3, want: 2},
+		{name: "keeps everything", from: 0, keep: 6, want: 0},
+		{name: "keep more than there is", from: 0, keep: 10, want: 0},
+		{name: "never before from", from: 3, keep: 4, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SummaryCut(conversation(6), tt.from, tt.keep); got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatSessionStoredPositions(t *testing.T) {
+	// The stored history holds a message the chat cannot replay at position
+	// 3, ahead of where the history is cut for a summary.
+	c := NewChatSession(&GeminiClient{})
+	c.AddUserMessage("one")
+	c.AddModelMessage("two")
+	c.Skip()
+	c.Messages = append(c.Messages, conversation(4)...)
+
+	cut := SummaryCut(c.Messages, 0, 2)
+	if cut != 4 {
+		t.Fatalf("got cut %d; want 4", cut)
+	}
+
+	// Storing the cut must cover the skipped message as well, and reading
+	// it back must land on the same message of the chat.
+	stored := c.Stored(cut)
+	if stored != 5 {
+		t.Errorf("Stored(%d): got %d; want 5", cut, stored)
+	}
+	if got := c.Index(stored); got != cut {
+		t.Errorf("Index(%d): got %d; want %d", stored, got, cut)
+	}
+
+	tests := []struct {
+		stored int
+		want   int
+	}{
+		{stored: 0, want: 0},
+		{stored: 2, want: 2},
+		{stored: 3, want: 2},
+		{stored: 7, want: 6},
+	}
+
+	for _, tt := range tests {
+		if got := c.Index(tt.stored); got != tt.want {
+			t.Errorf("Index(%d): got %d; want %d", tt.stored, got, tt.want)
+		}
+	}
+	if got := c.Stored(2); got != 2 {
+		t.Errorf("Stored(2): got %d; want 2", got)
+	}
+}
+
+// recordingProvider replies with text and records the last prompt and
+// options it got.
+type recordingProvider struct {
+	text   string
+	prompt []Data
+	opts   Options
+}
+
+func (p *recordingProvider) Name() string { return "recording" }
+
+func (p *recordingProvider) DefaultModel() string { return "recording-model" }
+
+func (p *recordingProvider) GenerateContent(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error) {
+	p.prompt = messages
+	p.opts = opts
+	return []string{p.text}, Usage{InputTokens: 10, OutputTokens: 3}, nil
+}
+
+func (p *recordingProvider) StreamContent(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error) {
+	p.prompt = messages
+	p.opts = opts
+	return p.text, Usage{InputTokens: 10, OutputTokens: 3}, nil
+}
+
+func TestGetChatSummary(t *testing.T) {
+	p := &recordingProvider{text: "  Planned a trip to Lisbon.\n"}
+	c := NewChatSession(p)
+
+	temperature, candidates := 0.2, 3
+	opts := Options{
+		System:     "You are a travel agent.",
+		Generation: GenerationConfig{Model: "travel-model", Temperature: &temperature, CandidateCount: &candidates},
+	}
+	summary, usage, err := c.GetChatSummary(context.Background(), "Talked about travel.", conversation(2), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != "Planned a trip to Lisbon." {
+		t.Errorf("got summary %q; want it trimmed", summary)
+	}
+	if usage != (Usage{InputTokens: 10, OutputTokens: 3}) {
+		t.Errorf("got usage %+v", usage)
+	}
+	// The summary takes the conversation's options, but only one candidate.
+	want := opts
+	want.Generation.CandidateCount = nil
+	if !reflect.DeepEqual(p.opts, want) {
+		t.Errorf("got options %+v; want %+v", p.opts, want)
+	}
+
+	// Only the new messages are sent, after the summary they extend.
+	if len(p.prompt) != 1 {
+		t.Fatalf("got %d prompt messages; want 1", len(p.prompt))
+	}
+	prompt := p.prompt[0].Text()
+	for _, want := range []string{chatSummaryPrompt, "Talked about travel.", "user: message", "model: message"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt %q does not contain %q", prompt, want)
+		}
+	}
+	if strings.Contains(prompt, summaryPrompt) {
+		t.Error("chat summary prompt uses the compaction instructions")
+	}
+}
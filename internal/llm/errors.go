@@ -0,0 +1,186 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors returned by providers. Provider failures are wrapped in an
+// *APIError, so callers should test for them with errors.Is.
+var (
+	ErrAuth        = errors.New("llm provider rejected the credentials")
+	ErrRateLimited = errors.New("llm provider rate limit or quota exceeded")
+	ErrUnavailable = errors.New("llm provider unavailable")
+	ErrBadRequest  = errors.New("llm provider rejected the request")
+	ErrBlocked     = errors.New("llm response blocked by safety filters")
+	// ErrTruncated is returned together with the text generated before the
+	// model hit its output token limit.
+	ErrTruncated = errors.New("llm response truncated at the token limit")
+	// ErrUnsupportedPart is returned before calling the provider when a
+	// message holds content the provider cannot take.
+	ErrUnsupportedPart = errors.New("message part not supported by the llm provider")
+	// ErrUnsupportedSetting is returned before calling the provider when a
+	// generation setting cannot be sent to it.
+	ErrUnsupportedSetting = errors.New("generation setting not supported by the llm provider")
+)
+
+// APIError is a failed call to a provider.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+	// RetryAfter is the delay requested by the provider, if any.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s: %s", e.Provider, e.Err, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (status %d): %s", e.Provider, e.Err, e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// checkResponse turns an unsuccessful HTTP response into an *APIError. All
+// supported providers report errors as {"error": {"message": "..."}}.
+func checkResponse(provider string, resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var errorBody struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := string(body)
+	if json.Unmarshal(body, &errorBody) == nil && errorBody.Error.Message != "" {
+		message = errorBody.Error.Message
+	}
+
+	apiErr := &APIError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		apiErr.Err = ErrAuth
+	case resp.StatusCode == http.StatusTooManyRequests:
+		apiErr.Err = ErrRateLimited
+	case resp.StatusCode >= 500:
+		// Anthropic reports overload as 529.
+		apiErr.Err = ErrUnavailable
+	default:
+		apiErr.Err = ErrBadRequest
+	}
+
+	return apiErr
+}
+
+// finishError reports a reply that was blocked or cut short.
+func finishError(provider string, err error, reason string) error {
+	return &APIError{Provider: provider, Message: "finish reason " + reason, Err: err}
+}
+
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// temporary reports whether a call that failed with err may succeed when
+// repeated.
+func temporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+const (
+	maxAttempts = 3
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 10 * time.Second
+)
+
+// RetryBound returns the longest a retried call can take when each attempt
+// is bounded by timeout, or by the default timeout when it is zero.
+func RetryBound(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return maxAttempts*timeout + (maxAttempts-1)*maxBackoff
+}
+
+// retry calls fn until it succeeds, fails with an error that retryable
+// rejects or maxAttempts is reached. It waits with full jitter exponential
+// backoff between attempts, or as long as the provider asked for.
+func retry(ctx context.Context, fn func() error, retryable func(error) bool) error {
+	var err error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = fn()
+		if err == nil || !retryable(err) || attempt == maxAttempts-1 {
+			return err
+		}
+
+		backoff := baseBackoff << attempt
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		delay := time.Duration(rand.Int63n(int64(backoff)))
+
+		// Give up straight away when the provider asks for a longer pause
+		// than we are prepared to hold the request for.
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			if apiErr.RetryAfter > maxBackoff {
+				return err
+			}
+			delay = apiErr.RetryAfter
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status      int
+		body        string
+		retryAfter  string
+		wantErr     error
+		wantMessage string
+		wantDelay   time.Duration
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusUnauthorized, body: `{"error": {"message": "bad key"}}`, wantErr: ErrAuth, wantMessage: "bad key"},
+		{status: http.StatusForbidden, body: "forbidden", wantErr: ErrAuth, wantMessage: "forbidden"},
+		{status: http.StatusTooManyRequests, retryAfter: "2", wantErr: ErrRateLimited, wantDelay: 2 * time.Second},
+		{status: http.StatusBadRequest, body: `{"error": {}}`, wantErr: ErrBadRequest, wantMessage: `{"error": {}}`},
+		{status: http.StatusInternalServerError, wantErr: ErrUnavailable},
+		{status: 529, wantErr: ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(tt.body)),
+		}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+
+		err := checkResponse("test", resp)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("status %d: got error %v; want %v", tt.status, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("status %d: got %T; want *APIError", tt.status, err)
+			continue
+		}
+		if apiErr.StatusCode != tt.status || apiErr.Message != tt.wantMessage || apiErr.RetryAfter != tt.wantDelay {
+			t.Errorf("status %d: got %+v; want message %q and retry after %s", tt.status, apiErr, tt.wantMessage, tt.wantDelay)
+		}
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limited", err: &APIError{Err: ErrRateLimited}, want: true},
+		{name: "unavailable", err: &APIError{Err: ErrUnavailable}, want: true},
+		{name: "network", err: &url.Error{Op: "Post", Err: netErr}, want: true},
+		{name: "auth", err: &APIError{Err: ErrAuth}, want: false},
+		{name: "bad request", err: &APIError{Err: ErrBadRequest}, want: false},
+		{name: "blocked", err: finishError("test", ErrBlocked, "SAFETY"), want: false},
+		{name: "deadline", err: fmt.Errorf("call: %w", context.DeadlineExceeded), want: false},
+		{name: "canceled request", err: &url.Error{Op: "Post", Err: context.Canceled}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := temporary(tt.err); got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := &APIError{Err: ErrUnavailable, RetryAfter: time.Millisecond}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "recovers", errs: []error{unavailable, nil}, wantCalls: 2},
+		{name: "not retryable", errs: []error{&APIError{Err: ErrAuth}}, wantCalls: 1, wantErr: ErrAuth},
+		{name: "gives up", errs: []error{unavailable, unavailable, unavailable, nil}, wantCalls: maxAttempts, wantErr: ErrUnavailable},
+		{name: "long retry after", errs: []error{&APIError{Err: ErrRateLimited, RetryAfter: time.Minute}, nil}, wantCalls: 1, wantErr: ErrRateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry(context.Background(), func() error {
+				calls++
+				return tt.errs[calls-1]
+			}, temporary)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	err := retry(ctx, func() error {
+		calls++
+		cancel()
+		return &APIError{Err: ErrUnavailable}
+	}, temporary)
+
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got error %v; want %v", err, ErrUnavailable)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls; want 1", calls)
+	}
+}
+
+func TestRetryBound(t *testing.T) {
+	if got, want := RetryBound(time.Minute), 3*time.Minute+20*time.Second; got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+	if got, want := RetryBound(0), RetryBound(defaultTimeout); got != want {
+		t.Errorf("got %s for a zero timeout; want %s", got, want)
+	}
+}
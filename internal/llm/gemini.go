@@ -1,39 +1,30 @@
 package llm
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io"
-	"net/http"
+	"strings"
+	"time"
 )
 
-var (
-	ErrNoResponseFromGemini = errors.New("no response from Gemini")
-)
-
-type ChatSession struct {
-	client   *GeminiClient
-	Messages []Data
-}
-
 type GeminiClient struct {
-	APIKey string
-	Model  string
+	APIKey  string
+	Model   string
+	BaseURL string
+	Timeout time.Duration
 }
 
 func NewGeminiClient(apiKey string) *GeminiClient {
 	return &GeminiClient{
-		APIKey: apiKey,
-		Model:  "gemini-2.0-flash",
+		APIKey:  apiKey,
+		Model:   "gemini-2.0-flash",
+		BaseURL: "https://generativelanguage.googleapis.com/v1beta",
+		Timeout: defaultTimeout,
 	}
 }
 
-type Data struct {
-	Role  string              `json:"role"`
-	Parts []map[string]string `json:"parts"`
-}
-
 type GeminiResponse struct {
 	Candidates []struct {
 		Content struct {
@@ -41,77 +32,232 @@ type GeminiResponse struct {
 				Text string `json:"text"`
 			} `json:"parts"`
 		} `json:"content"`
+		FinishReason string `json:"finishReason"`
 	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
 }
 
-func NewChatSession(client *GeminiClient) *ChatSession {
-	if client == nil {
-		panic("gemini client cannot be nil")
+func (r GeminiResponse) text() string {
+	if len(r.Candidates) == 0 {
+		return ""
 	}
-	return &ChatSession{
-		client:   client,
-		Messages: []Data{},
+	return r.candidates()[0]
+}
+
+// candidates returns the text of each candidate.
+func (r GeminiResponse) candidates() []string {
+	texts := make([]string, 0, len(r.Candidates))
+	for _, candidate := range r.Candidates {
+		var sb strings.Builder
+		for _, part := range candidate.Content.Parts {
+			sb.WriteString(part.Text)
+		}
+		texts = append(texts, sb.String())
 	}
+	return texts
 }
 
-func (c *ChatSession) AddUserMessage(text string) {
-	c.Messages = append(c.Messages, Data{
-		Role:  "user",
-		Parts: []map[string]string{{"text": text}},
-	})
+// finishErr reports a blocked prompt or a reply that was blocked or cut
+// short.
+func (r GeminiResponse) finishErr() error {
+	if r.PromptFeedback.BlockReason != "" {
+		return finishError(ProviderGemini, ErrBlocked, r.PromptFeedback.BlockReason)
+	}
+
+	if len(r.Candidates) == 0 {
+		return nil
+	}
+
+	switch reason := r.Candidates[0].FinishReason; reason {
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return finishError(ProviderGemini, ErrBlocked, reason)
+	case "MAX_TOKENS":
+		return finishError(ProviderGemini, ErrTruncated, reason)
+	default:
+		return nil
+	}
 }
 
-func (c *ChatSession) AddModelMessage(text string) {
-	c.Messages = append(c.Messages, Data{
-		Role:  "model",
-		Parts: []map[string]string{{"text": text}},
-	})
+func (r GeminiResponse) usage() Usage {
+	return Usage{
+		InputTokens:  r.UsageMetadata.PromptTokenCount,
+		OutputTokens: r.UsageMetadata.CandidatesTokenCount,
+	}
 }
 
-func (c *ChatSession) GetGeminiResponse(messages []Data) (string, error) {
-	url := "https://generativelanguage.googleapis.com/v1beta/models/" + c.client.Model + ":generateContent?key=" + c.client.APIKey
+func (g *GeminiClient) Name() string {
+	return ProviderGemini
+}
 
-	// Construct request payload
-	payload := map[string]interface{}{
-		"contents": messages,
+func (g *GeminiClient) DefaultModel() string {
+	return g.Model
+}
+
+func (g *GeminiClient) GenerateContent(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+
+	url := g.BaseURL + "/models/" + g.model(opts) + ":generateContent"
+
+	payload, err := g.payload(messages, opts)
+	if err != nil {
+		return nil, Usage{}, err
 	}
 
-	reqBody, err := json.Marshal(payload)
+	resp, err := postJSON(ctx, url, g.headers(), payload)
 	if err != nil {
-		return "", err
+		return nil, Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(ProviderGemini, resp); err != nil {
+		return nil, Usage{}, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", nil
+		return nil, Usage{}, err
+	}
+
+	var geminiRes GeminiResponse
+	if err := json.Unmarshal(body, &geminiRes); err != nil {
+		return nil, Usage{}, err
+	}
+
+	candidates := geminiRes.candidates()
+	if err := geminiRes.finishErr(); err != nil {
+		return candidates, geminiRes.usage(), err
+	}
+
+	if geminiRes.text() != "" {
+		return candidates, geminiRes.usage(), nil
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return nil, geminiRes.usage(), ErrNoResponse
+}
+
+func (g *GeminiClient) StreamContent(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+
+	if opts.Generation.candidates() > 1 {
+		return "", Usage{}, fmt.Errorf("%w: candidate_count when streaming", ErrUnsupportedSetting)
+	}
+
+	url := g.BaseURL + "/models/" + g.model(opts) + ":streamGenerateContent?alt=sse"
+
+	payload, err := g.payload(messages, opts)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
+	resp, err := postJSON(ctx, url, g.headers(), payload)
+	if err != nil {
+		return "", Usage{}, err
+	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if err := checkResponse(ProviderGemini, resp); err != nil {
+		return "", Usage{}, err
+	}
+
+	var sb strings.Builder
+	var finishErr error
+	var usage Usage
+	err = readEvents(resp.Body, func(data []byte) error {
+		var geminiRes GeminiResponse
+		if err := json.Unmarshal(data, &geminiRes); err != nil {
+			return err
+		}
+
+		// Every chunk carries the usage so far.
+		if u := geminiRes.usage(); u.Total() > 0 {
+			usage = u
+		}
+		if err := geminiRes.finishErr(); err != nil {
+			finishErr = err
+		}
+
+		chunk := geminiRes.text()
+		if chunk == "" {
+			return nil
+		}
+		sb.WriteString(chunk)
+		return fn(chunk)
+	})
 	if err != nil {
-		return "", err
+		return sb.String(), usage, err
 	}
 
-	var geminiRes GeminiResponse
-	if err := json.Unmarshal(body, &geminiRes); err != nil {
-		return "", err
+	if finishErr != nil {
+		return sb.String(), usage, finishErr
 	}
 
-	if len(geminiRes.Candidates) > 0 && len(geminiRes.Candidates[0].Content.Parts) > 0 {
-		return geminiRes.Candidates[0].Content.Parts[0].Text, nil
+	if sb.Len() == 0 {
+		return "", usage, ErrNoResponse
 	}
 
-	return "", ErrNoResponseFromGemini
+	return sb.String(), usage, nil
+}
+
+// headers sends the API key in a header rather than the URL, so that it
+// does not end up in logged transport errors.
+func (g *GeminiClient) headers() map[string]string {
+	return map[string]string{"x-goog-api-key": g.APIKey}
 }
 
-// func GetChatSummary(message []Data) (string, error) {
+// model returns the model asked for in opts, or the client's default.
+func (g *GeminiClient) model(opts Options) string {
+	if opts.Generation.Model != "" {
+		return opts.Generation.Model
+	}
+	return g.Model
+}
+
+// payload sends messages as they are, since Data follows Gemini's content
+// format. Gemini takes every attachment type that can be uploaded and every
+// generation setting.
+func (g *GeminiClient) payload(messages []Data, opts Options) (map[string]interface{}, error) {
+	err := checkParts(messages, func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"contents": messages,
+	}
+	if opts.System != "" {
+		payload["systemInstruction"] = Data{Parts: []Part{TextPart(opts.System)}}
+	}
 
-// }
+	gen := opts.Generation
+	config := map[string]interface{}{}
+	if gen.Temperature != nil {
+		config["temperature"] = *gen.Temperature
+	}
+	if gen.TopP != nil {
+		config["topP"] = *gen.TopP
+	}
+	if gen.TopK != nil {
+		config["topK"] = *gen.TopK
+	}
+	if gen.MaxOutputTokens != nil {
+		config["maxOutputTokens"] = *gen.MaxOutputTokens
+	}
+	if len(gen.StopSequences) > 0 {
+		config["stopSequences"] = gen.StopSequences
+	}
+	if gen.CandidateCount != nil {
+		config["candidateCount"] = *gen.CandidateCount
+	}
+	if len(config) > 0 {
+		payload["generationConfig"] = config
+	}
+	return payload, nil
+}
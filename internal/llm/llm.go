@@ -0,0 +1,437 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"misc.sahilsasane.net/internal/metrics"
+)
+
+var (
+	ErrNoResponse      = errors.New("no response from model")
+	ErrUnknownProvider = errors.New("unknown llm provider")
+	ErrMissingAPIKey   = errors.New("missing llm api key")
+)
+
+var (
+	requestDuration = metrics.NewHistogramVec(
+		"llm_request_duration_seconds",
+		"Duration of model calls by provider, operation and outcome.",
+		metrics.SlowBuckets,
+		"provider", "operation", "outcome",
+	)
+	tokensTotal = metrics.NewCounterVec(
+		"llm_tokens_total",
+		"Tokens consumed by model calls.",
+		"provider", "type",
+	)
+)
+
+const (
+	ProviderGemini    = "gemini"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+)
+
+// Provider is implemented by every model backend. Messages use the Gemini
+// style roles ("user" and "model"); each provider translates them into its
+// own wire format.
+//
+// GenerateContent returns the text of every candidate the model generated,
+// of which the first is the reply. There is more than one only when
+// Generation.CandidateCount asks for it.
+//
+// StreamContent calls fn with each chunk of text as it arrives and returns
+// the text received so far, even when the stream ends with an error. It
+// only streams a single candidate.
+//
+// Both report the token usage returned by the provider, which is zero when
+// the provider does not report it.
+type Provider interface {
+	Name() string
+	// DefaultModel is the model used when a call does not select one.
+	DefaultModel() string
+	GenerateContent(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error)
+	StreamContent(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error)
+}
+
+// Options apply to a single call. The zero value sends the messages alone
+// with the provider's default settings.
+type Options struct {
+	// System is the system instruction, sent separately from the messages.
+	System string
+	// Generation selects the model and its sampling settings.
+	Generation GenerationConfig
+}
+
+// GenerationConfig holds the model and sampling settings of a call. Unset
+// fields keep the provider's defaults. A setting the provider does not
+// support fails the call with ErrUnsupportedSetting.
+type GenerationConfig struct {
+	Model           string   `json:"model,omitempty" bson:"model,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty" bson:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty" bson:"top_p,omitempty"`
+	TopK            *int     `json:"top_k,omitempty" bson:"top_k,omitempty"`
+	MaxOutputTokens *int     `json:"max_output_tokens,omitempty" bson:"max_output_tokens,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty" bson:"stop_sequences,omitempty"`
+	CandidateCount  *int     `json:"candidate_count,omitempty" bson:"candidate_count,omitempty"`
+}
+
+// Merge returns c with every setting that is set in override replaced.
+func (c GenerationConfig) Merge(override GenerationConfig) GenerationConfig {
+	if override.Model != "" {
+		c.Model = override.Model
+	}
+	if override.Temperature != nil {
+		c.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		c.TopP = override.TopP
+	}
+	if override.TopK != nil {
+		c.TopK = override.TopK
+	}
+	if override.MaxOutputTokens != nil {
+		c.MaxOutputTokens = override.MaxOutputTokens
+	}
+	if override.StopSequences != nil {
+		c.StopSequences = override.StopSequences
+	}
+	if override.CandidateCount != nil {
+		c.CandidateCount = override.CandidateCount
+	}
+	return c
+}
+
+// IsZero reports whether none of the settings are set.
+func (c GenerationConfig) IsZero() bool {
+	return c.Model == "" && c.Temperature == nil && c.TopP == nil && c.TopK == nil &&
+		c.MaxOutputTokens == nil && c.StopSequences == nil && c.CandidateCount == nil
+}
+
+// candidates returns the number of candidates asked for.
+func (c GenerationConfig) candidates() int {
+	if c.CandidateCount == nil {
+		return 1
+	}
+	return *c.CandidateCount
+}
+
+// Usage is the number of tokens consumed by a single model call.
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+// estimateUsage approximates token counts at four characters per token for
+// providers, mostly local servers, that do not report usage.
+func estimateUsage(messages []Data, opts Options, text string) Usage {
+	input := len(opts.System)
+	for _, msg := range messages {
+		input += len(msg.Text())
+	}
+
+	return Usage{
+		InputTokens:  (input + 3) / 4,
+		OutputTokens: (len(text) + 3) / 4,
+	}
+}
+
+// Config selects and configures a provider. Timeout bounds each call,
+// including reading a streamed reply; zero keeps the provider's default.
+type Config struct {
+	Provider string
+	Model    string
+	BaseURL  string
+	APIKey   string
+	Timeout  time.Duration
+}
+
+const defaultTimeout = 2 * time.Minute
+
+// httpClient is shared by all providers so that connections are reused.
+// Calls are bounded by their context rather than a client timeout, which
+// would also cut off long streamed replies.
+var httpClient = &http.Client{}
+
+func NewProvider(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderGemini:
+		if cfg.APIKey == "" {
+			return nil, ErrMissingAPIKey
+		}
+		client := NewGeminiClient(cfg.APIKey)
+		if cfg.Model != "" {
+			client.Model = cfg.Model
+		}
+		if cfg.BaseURL != "" {
+			client.BaseURL = cfg.BaseURL
+		}
+		if cfg.Timeout > 0 {
+			client.Timeout = cfg.Timeout
+		}
+		return client, nil
+	case ProviderOpenAI:
+		// The API key is optional so that local OpenAI-compatible servers
+		// (llama.cpp, vLLM, Ollama) can be used without one.
+		client := NewOpenAIClient(cfg.APIKey, cfg.Model, cfg.BaseURL)
+		if cfg.Timeout > 0 {
+			client.Timeout = cfg.Timeout
+		}
+		return client, nil
+	case ProviderAnthropic:
+		if cfg.APIKey == "" {
+			return nil, ErrMissingAPIKey
+		}
+		client := NewAnthropicClient(cfg.APIKey, cfg.Model, cfg.BaseURL)
+		if cfg.Timeout > 0 {
+			client.Timeout = cfg.Timeout
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, cfg.Provider)
+	}
+}
+
+// Data is a single message. Its parts are sent to the model in order.
+type Data struct {
+	Role  string `json:"role"`
+	Parts []Part `json:"parts"`
+}
+
+// Part is one piece of a message and has exactly one of its fields set.
+// File refers to an uploaded attachment; it is stored with the message and
+// must be replaced with the attachment's InlineData before the message is
+// sent to a provider.
+type Part struct {
+	Text       string      `json:"text,omitempty" bson:"text,omitempty"`
+	InlineData *InlineData `json:"inline_data,omitempty" bson:"inline_data,omitempty"`
+	File       *File       `json:"file,omitempty" bson:"file,omitempty"`
+}
+
+// InlineData is binary content such as an image or a PDF. Data is base64
+// encoded in JSON.
+type InlineData struct {
+	MimeType string `json:"mime_type" bson:"mime_type"`
+	Data     []byte `json:"data" bson:"data"`
+}
+
+// File references an uploaded attachment.
+type File struct {
+	AttachmentId string `json:"attachment_id" bson:"attachment_id"`
+	MimeType     string `json:"mime_type,omitempty" bson:"mime_type,omitempty"`
+	Name         string `json:"name,omitempty" bson:"name,omitempty"`
+}
+
+func TextPart(text string) Part {
+	return Part{Text: text}
+}
+
+// checkParts makes sure every attachment has been resolved and is of a type
+// the provider accepts.
+func checkParts(messages []Data, supported func(mimeType string) bool) error {
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			switch {
+			case part.File != nil:
+				return fmt.Errorf("%w: unresolved attachment %s", ErrUnsupportedPart, part.File.AttachmentId)
+			case part.InlineData != nil && !supported(part.InlineData.MimeType):
+				return fmt.Errorf("%w: %s", ErrUnsupportedPart, part.InlineData.MimeType)
+			}
+		}
+	}
+	return nil
+}
+
+// portableMimeType reports whether both the OpenAI and the Anthropic APIs
+// take inline data of mimeType. Plain text is sent as a text part.
+func portableMimeType(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/webp", "image/gif", "application/pdf", "text/plain":
+		return true
+	default:
+		return false
+	}
+}
+
+// dataURL encodes inline data for APIs that take images as URLs.
+func dataURL(data *InlineData) string {
+	return "data:" + data.MimeType + ";base64," + base64.StdEncoding.EncodeToString(data.Data)
+}
+
+// Text joins the text parts of a message.
+func (d Data) Text() string {
+	texts := []string{}
+	for _, part := range d.Parts {
+		if part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+type ChatSession struct {
+	provider Provider
+	Messages []Data
+	// skipped holds the positions, counting from 1, of stored messages that
+	// were left out of Messages, in increasing order.
+	skipped []int
+}
+
+func NewChatSession(provider Provider) *ChatSession {
+	if provider == nil {
+		panic("llm provider cannot be nil")
+	}
+	return &ChatSession{
+		provider: provider,
+		Messages: []Data{},
+	}
+}
+
+func (c *ChatSession) AddMessage(msg Data) {
+	c.Messages = append(c.Messages, msg)
+}
+
+func (c *ChatSession) AddUserMessage(text string) {
+	c.AddMessage(Data{Role: "user", Parts: []Part{TextPart(text)}})
+}
+
+func (c *ChatSession) AddModelMessage(text string) {
+	c.AddMessage(Data{Role: "model", Parts: []Part{TextPart(text)}})
+}
+
+// Skip records that the next stored message was left out of the chat, so
+// that positions in the stored history can still be mapped onto Messages.
+func (c *ChatSession) Skip() {
+	c.skipped = append(c.skipped, len(c.Messages)+len(c.skipped)+1)
+}
+
+// Index returns how many of the first stored messages are in the chat.
+func (c *ChatSession) Index(stored int) int {
+	n := stored
+	for _, position := range c.skipped {
+		if position <= stored {
+			n--
+		}
+	}
+	return n
+}
+
+// Stored returns how many stored messages the first n messages of the chat
+// span.
+func (c *ChatSession) Stored(n int) int {
+	stored := n
+	for _, position := range c.skipped {
+		if position <= stored {
+			stored++
+		}
+	}
+	return stored
+}
+
+// GetResponse generates a reply, retrying transient provider failures.
+func (c *ChatSession) GetResponse(ctx context.Context, messages []Data, opts Options) (string, Usage, error) {
+	candidates, usage, err := c.generate(ctx, "generate", messages, opts)
+	if len(candidates) == 0 {
+		return "", usage, err
+	}
+	return candidates[0], usage, err
+}
+
+// GetCandidates is like GetResponse, but also returns the candidates after
+// the reply when opts asks for more than one.
+func (c *ChatSession) GetCandidates(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error) {
+	return c.generate(ctx, "generate", messages, opts)
+}
+
+func (c *ChatSession) generate(ctx context.Context, operation string, messages []Data, opts Options) ([]string, Usage, error) {
+	start := time.Now()
+
+	var candidates []string
+	var usage Usage
+	err := retry(ctx, func() error {
+		var err error
+		candidates, usage, err = c.provider.GenerateContent(ctx, messages, opts)
+		return err
+	}, temporary)
+	if usage.Total() == 0 && len(candidates) > 0 {
+		usage = estimateUsage(messages, opts, strings.Join(candidates, ""))
+	}
+	c.observe(operation, start, usage, err)
+	return candidates, usage, err
+}
+
+// StreamResponse streams a reply. Transient failures are only retried while
+// nothing has been passed to fn yet.
+func (c *ChatSession) StreamResponse(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error) {
+	start := time.Now()
+
+	var text string
+	var usage Usage
+	emitted := false
+	err := retry(ctx, func() error {
+		var err error
+		text, usage, err = c.provider.StreamContent(ctx, messages, opts, func(chunk string) error {
+			emitted = true
+			return fn(chunk)
+		})
+		return err
+	}, func(err error) bool {
+		return !emitted && temporary(err)
+	})
+	if usage.Total() == 0 && text != "" {
+		usage = estimateUsage(messages, opts, text)
+	}
+	c.observe("stream", start, usage, err)
+	return text, usage, err
+}
+
+func (c *ChatSession) observe(operation string, start time.Time, usage Usage, err error) {
+	outcome := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrTruncated):
+		outcome = "truncated"
+	case errors.Is(err, ErrBlocked):
+		outcome = "blocked"
+	case errors.Is(err, ErrRateLimited):
+		outcome = "rate_limited"
+	default:
+		outcome = "error"
+	}
+
+	name := c.provider.Name()
+	requestDuration.Observe(time.Since(start).Seconds(), name, operation, outcome)
+	tokensTotal.Add(float64(usage.InputTokens), name, "input")
+	tokensTotal.Add(float64(usage.OutputTokens), name, "output")
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, payload interface{}) (*http.Response, error) {
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	return httpClient.Do(req)
+}
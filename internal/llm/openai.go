@@ -0,0 +1,314 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// OpenAIClient talks to any server implementing the OpenAI chat completions
+// API, which includes local llama.cpp, vLLM and Ollama servers.
+type OpenAIClient struct {
+	APIKey  string
+	Model   string
+	BaseURL string
+	Timeout time.Duration
+}
+
+func NewOpenAIClient(apiKey, model, baseURL string) *OpenAIClient {
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	return &OpenAIClient{
+		APIKey:  apiKey,
+		Model:   model,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Timeout: defaultTimeout,
+	}
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OpenAIResponse struct {
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		Delta        openAIMessage `json:"delta"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (r OpenAIResponse) usage() Usage {
+	if r.Usage == nil {
+		return Usage{}
+	}
+	return Usage{
+		InputTokens:  r.Usage.PromptTokens,
+		OutputTokens: r.Usage.CompletionTokens,
+	}
+}
+
+func (o *OpenAIClient) Name() string {
+	return ProviderOpenAI
+}
+
+func (o *OpenAIClient) DefaultModel() string {
+	return o.Model
+}
+
+func (o *OpenAIClient) GenerateContent(ctx context.Context, messages []Data, opts Options) ([]string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+	defer cancel()
+
+	payload, err := o.payload(messages, opts, false)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+
+	resp, err := postJSON(ctx, o.BaseURL+"/chat/completions", o.headers(), payload)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(ProviderOpenAI, resp); err != nil {
+		return nil, Usage{}, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+
+	var openAIRes OpenAIResponse
+	if err := json.Unmarshal(body, &openAIRes); err != nil {
+		return nil, Usage{}, err
+	}
+
+	if len(openAIRes.Choices) == 0 {
+		return nil, openAIRes.usage(), ErrNoResponse
+	}
+
+	candidates := make([]string, 0, len(openAIRes.Choices))
+	for _, choice := range openAIRes.Choices {
+		candidates = append(candidates, choice.Message.Content)
+	}
+
+	if err := openAIFinishErr(openAIRes.Choices[0].FinishReason); err != nil {
+		return candidates, openAIRes.usage(), err
+	}
+
+	if candidates[0] != "" {
+		return candidates, openAIRes.usage(), nil
+	}
+
+	return nil, openAIRes.usage(), ErrNoResponse
+}
+
+func (o *OpenAIClient) StreamContent(ctx context.Context, messages []Data, opts Options, fn func(chunk string) error) (string, Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+	defer cancel()
+
+	payload, err := o.payload(messages, opts, true)
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	resp, err := postJSON(ctx, o.BaseURL+"/chat/completions", o.headers(), payload)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(ProviderOpenAI, resp); err != nil {
+		return "", Usage{}, err
+	}
+
+	var sb strings.Builder
+	var usage Usage
+	var finishErr error
+	err = readEvents(resp.Body, func(data []byte) error {
+		var openAIRes OpenAIResponse
+		if err := json.Unmarshal(data, &openAIRes); err != nil {
+			return err
+		}
+
+		// The usage arrives in a final chunk without choices.
+		if u := openAIRes.usage(); u.Total() > 0 {
+			usage = u
+		}
+
+		if len(openAIRes.Choices) == 0 {
+			return nil
+		}
+
+		if err := openAIFinishErr(openAIRes.Choices[0].FinishReason); err != nil {
+			finishErr = err
+		}
+
+		if openAIRes.Choices[0].Delta.Content == "" {
+			return nil
+		}
+
+		chunk := openAIRes.Choices[0].Delta.Content
+		sb.WriteString(chunk)
+		return fn(chunk)
+	})
+	if err != nil {
+		return sb.String(), usage, err
+	}
+
+	if finishErr != nil {
+		return sb.String(), usage, finishErr
+	}
+
+	if sb.Len() == 0 {
+		return "", usage, ErrNoResponse
+	}
+
+	return sb.String(), usage, nil
+}
+
+func openAIFinishErr(reason string) error {
+	switch reason {
+	case "content_filter":
+		return finishError(ProviderOpenAI, ErrBlocked, reason)
+	case "length":
+		return finishError(ProviderOpenAI, ErrTruncated, reason)
+	default:
+		return nil
+	}
+}
+
+func (o *OpenAIClient) headers() map[string]string {
+	if o.APIKey == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + o.APIKey}
+}
+
+// payload builds a chat completion request. top_k is not part of the OpenAI
+// API, but is sent when set since local servers take it.
+func (o *OpenAIClient) payload(messages []Data, opts Options, stream bool) (map[string]interface{}, error) {
+	gen := opts.Generation
+	if stream && gen.candidates() > 1 {
+		return nil, fmt.Errorf("%w: candidate_count when streaming", ErrUnsupportedSetting)
+	}
+	if len(gen.StopSequences) > 4 {
+		return nil, fmt.Errorf("%w: more than 4 stop_sequences", ErrUnsupportedSetting)
+	}
+
+	openAIMessages, err := toOpenAIMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.System != "" {
+		system := openAIRequestMessage{Role: "system", Content: opts.System}
+		openAIMessages = append([]openAIRequestMessage{system}, openAIMessages...)
+	}
+
+	model := o.Model
+	if gen.Model != "" {
+		model = gen.Model
+	}
+
+	payload := map[string]interface{}{
+		"model":    model,
+		"messages": openAIMessages,
+		"stream":   stream,
+	}
+	if stream {
+		payload["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	if gen.Temperature != nil {
+		payload["temperature"] = *gen.Temperature
+	}
+	if gen.TopP != nil {
+		payload["top_p"] = *gen.TopP
+	}
+	if gen.TopK != nil {
+		payload["top_k"] = *gen.TopK
+	}
+	if gen.MaxOutputTokens != nil {
+		payload["max_tokens"] = *gen.MaxOutputTokens
+	}
+	if len(gen.StopSequences) > 0 {
+		payload["stop"] = gen.StopSequences
+	}
+	if gen.CandidateCount != nil {
+		payload["n"] = *gen.CandidateCount
+	}
+	return payload, nil
+}
+
+// openAIRequestMessage is a message as sent to the API. Content is a plain
+// string unless the message has attachments, so that servers without
+// multimodal support keep working for text.
+type openAIRequestMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+func toOpenAIMessages(messages []Data) ([]openAIRequestMessage, error) {
+	err := checkParts(messages, portableMimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]openAIRequestMessage, 0, len(messages))
+	for _, msg := range messages {
+		role := msg.Role
+		if role == "model" {
+			role = "assistant"
+		}
+
+		if !hasInlineData(msg) {
+			result = append(result, openAIRequestMessage{Role: role, Content: msg.Text()})
+			continue
+		}
+
+		content := []map[string]interface{}{}
+		for _, part := range msg.Parts {
+			switch {
+			case part.InlineData == nil:
+				content = append(content, map[string]interface{}{"type": "text", "text": part.Text})
+			case part.InlineData.MimeType == "text/plain":
+				content = append(content, map[string]interface{}{"type": "text", "text": string(part.InlineData.Data)})
+			case part.InlineData.MimeType == "application/pdf":
+				content = append(content, map[string]interface{}{
+					"type": "file",
+					"file": map[string]string{"filename": "attachment.pdf", "file_data": dataURL(part.InlineData)},
+				})
+			default:
+				content = append(content, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]string{"url": dataURL(part.InlineData)},
+				})
+			}
+		}
+		result = append(result, openAIRequestMessage{Role: role, Content: content})
+	}
+	return result, nil
+}
+
+func hasInlineData(msg Data) bool {
+	for _, part := range msg.Parts {
+		if part.InlineData != nil {
+			return true
+		}
+	}
+	return false
+}
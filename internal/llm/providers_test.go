@@ -0,0 +1,259 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+var conversationFixture = []Data{
+	{Role: "user", Parts: []Part{TextPart("Hi")}},
+	{Role: "model", Parts: []Part{TextPart("Hello")}},
+	{Role: "user", Parts: []Part{TextPart("Bye")}},
+}
+
+func TestGenerateContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		newProvider func(baseURL string) Provider
+		path        string
+		query       string
+		headers     map[string]string
+		payload     string
+		response    string
+		want        []string
+		wantUsage   Usage
+	}{
+		{
+			name: "gemini",
+			newProvider: func(baseURL string) Provider {
+				p, _ := NewProvider(Config{Provider: ProviderGemini, APIKey: "key", BaseURL: baseURL, Timeout: defaultTimeout})
+				return p
+			},
+			path:      "/models/gemini-2.0-flash:generateContent",
+			headers:   map[string]string{"x-goog-api-key": "key"},
+			payload:   `{"systemInstruction": {"role": "", "parts": [{"text": "Be brief."}]}, "contents": [{"role": "user", "parts": [{"text": "Hi"}]}, {"role": "model", "parts": [{"text": "Hello"}]}, {"role": "user", "parts": [{"text": "Bye"}]}]}`,
+			response:  `{"candidates": [{"content": {"parts": [{"text": "Goodbye"}]}}], "usageMetadata": {"promptTokenCount": 7, "candidatesTokenCount": 2}}`,
+			want:      []string{"Goodbye"},
+			wantUsage: Usage{InputTokens: 7, OutputTokens: 2},
+		},
+		{
+			name: "openai",
+			newProvider: func(baseURL string) Provider {
+				return NewOpenAIClient("key", "local-model", baseURL+"/")
+			},
+			path:      "/chat/completions",
+			headers:   map[string]string{"Authorization": "Bearer key"},
+			payload:   `{"model": "local-model", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"}, {"role": "assistant", "content": "Hello"}, {"role": "user", "content": "Bye"}], "stream": false}`,
+			response:  `{"choices": [{"message": {"role": "assistant", "content": "Goodbye"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 7, "completion_tokens": 2}}`,
+			want:      []string{"Goodbye"},
+			wantUsage: Usage{InputTokens: 7, OutputTokens: 2},
+		},
+		{
+			name: "anthropic",
+			newProvider: func(baseURL string) Provider {
+				return NewAnthropicClient("key", "", baseURL)
+			},
+			path:      "/messages",
+			headers:   map[string]string{"x-api-key": "key", "anthropic-version": anthropicVersion},
+			payload:   `{"model": "claude-3-5-haiku-latest", "max_tokens": 4096, "system": "Be brief.", "messages": [{"role": "user", "content": "Hi"}, {"role": "assistant", "content": "Hello"}, {"role": "user", "content": "Bye"}], "stream": false}`,
+			response:  `{"content": [{"type": "text", "text": "Good"}, {"type": "tool_use"}, {"type": "text", "text": "bye"}], "stop_reason": "end_turn", "usage": {"input_tokens": 7, "output_tokens": 2}}`,
+			want:      []string{"Goodbye"},
+			wantUsage: Usage{InputTokens: 7, OutputTokens: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.path {
+					t.Errorf("got path %q; want %q", r.URL.Path, tt.path)
+				}
+				if r.URL.RawQuery != tt.query {
+					t.Errorf("got query %q; want %q", r.URL.RawQuery, tt.query)
+				}
+				for name, value := range tt.headers {
+					if got := r.Header.Get(name); got != value {
+						t.Errorf("got header %s %q; want %q", name, got, value)
+					}
+				}
+
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				assertJSON(t, body, tt.payload)
+
+				io.WriteString(w, tt.response)
+			}))
+			defer ts.Close()
+
+			got, usage, err := tt.newProvider(ts.URL).GenerateContent(context.Background(), conversationFixture, Options{System: "Be brief."})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+			if usage != tt.wantUsage {
+				t.Errorf("got usage %+v; want %+v", usage, tt.wantUsage)
+			}
+		})
+	}
+}
+
+func TestGenerateContentNoResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{}`)
+	}))
+	defer ts.Close()
+
+	providers := map[string]Provider{
+		"gemini":    &GeminiClient{APIKey: "key", Model: "m", BaseURL: ts.URL, Timeout: defaultTimeout},
+		"openai":    NewOpenAIClient("", "", ts.URL),
+		"anthropic": NewAnthropicClient("key", "", ts.URL),
+	}
+
+	for name, p := range providers {
+		_, _, err := p.GenerateContent(context.Background(), conversationFixture, Options{})
+		if !errors.Is(err, ErrNoResponse) {
+			t.Errorf("%s: got error %v; want %v", name, err, ErrNoResponse)
+		}
+	}
+}
+
+func TestGenerationPayload(t *testing.T) {
+	temperature, topK, maxTokens, candidates := 0.5, 40, 256, 2
+	gen := GenerationConfig{
+		Model:           "other-model",
+		Temperature:     &temperature,
+		TopK:            &topK,
+		MaxOutputTokens: &maxTokens,
+		StopSequences:   []string{"END"},
+	}
+	messages := conversationFixture[:1]
+
+	tests := []struct {
+		name    string
+		payload func(opts Options) (map[string]interface{}, error)
+		gen     GenerationConfig
+		want    string
+		wantErr error
+	}{
+		{
+			name: "gemini",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return (&GeminiClient{Model: "m"}).payload(messages, opts)
+			},
+			gen:  gen.Merge(GenerationConfig{CandidateCount: &candidates}),
+			want: `{"contents": [{"role": "user", "parts": [{"text": "Hi"}]}], "generationConfig": {"temperature": 0.5, "topK": 40, "maxOutputTokens": 256, "stopSequences": ["END"], "candidateCount": 2}}`,
+		},
+		{
+			name: "openai",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return NewOpenAIClient("", "m", "").payload(messages, opts, false)
+			},
+			gen:  gen.Merge(GenerationConfig{CandidateCount: &candidates}),
+			want: `{"model": "other-model", "messages": [{"role": "user", "content": "Hi"}], "stream": false, "temperature": 0.5, "top_k": 40, "max_tokens": 256, "stop": ["END"], "n": 2}`,
+		},
+		{
+			name: "openai streaming candidates",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return NewOpenAIClient("", "m", "").payload(messages, opts, true)
+			},
+			gen:     GenerationConfig{CandidateCount: &candidates},
+			wantErr: ErrUnsupportedSetting,
+		},
+		{
+			name: "openai stop sequences",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return NewOpenAIClient("", "m", "").payload(messages, opts, false)
+			},
+			gen:     GenerationConfig{StopSequences: []string{"a", "b", "c", "d", "e"}},
+			wantErr: ErrUnsupportedSetting,
+		},
+		{
+			name: "anthropic",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return NewAnthropicClient("key", "m", "").payload(messages, opts, false)
+			},
+			gen:  gen,
+			want: `{"model": "other-model", "max_tokens": 256, "messages": [{"role": "user", "content": "Hi"}], "stream": false, "temperature": 0.5, "top_k": 40, "stop_sequences": ["END"]}`,
+		},
+		{
+			name: "anthropic candidates",
+			payload: func(opts Options) (map[string]interface{}, error) {
+				return NewAnthropicClient("key", "m", "").payload(messages, opts, false)
+			},
+			gen:     GenerationConfig{CandidateCount: &candidates},
+			wantErr: ErrUnsupportedSetting,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.payload(Options{Generation: tt.gen})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			body, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, body, tt.want)
+		})
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	tests := []struct {
+		cfg      Config
+		wantName string
+		wantErr  error
+	}{
+		{cfg: Config{Provider: ProviderGemini, APIKey: "key"}, wantName: ProviderGemini},
+		{cfg: Config{Provider: ProviderGemini}, wantErr: ErrMissingAPIKey},
+		{cfg: Config{Provider: ProviderOpenAI}, wantName: ProviderOpenAI},
+		{cfg: Config{Provider: ProviderAnthropic}, wantErr: ErrMissingAPIKey},
+		{cfg: Config{Provider: "bard"}, wantErr: ErrUnknownProvider},
+	}
+
+	for _, tt := range tests {
+		p, err := NewProvider(tt.cfg)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%+v: got error %v; want %v", tt.cfg, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.Name() != tt.wantName {
+			t.Errorf("%+v: got provider %q; want %q", tt.cfg, p.Name(), tt.wantName)
+		}
+	}
+}
+
+// assertJSON fails the test unless got and want encode the same JSON value.
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Errorf("invalid JSON %q: %v", got, err)
+		return
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Errorf("invalid JSON %q: %v", want, err)
+		return
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got JSON %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package llm
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// readEvents reads a server-sent event stream and calls fn with the payload
+// of every data line. It stops at the first error returned by fn.
+func readEvents(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" || data == "[DONE]" {
+			continue
+		}
+
+		if err := fn([]byte(data)); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,173 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{
+			name:   "data lines",
+			stream: "data: {\"a\":1}\n\ndata: {\"a\":2}\n\n",
+			want:   []string{`{"a":1}`, `{"a":2}`},
+		},
+		{
+			name:   "without a space",
+			stream: "data:{\"a\":1}\n\n",
+			want:   []string{`{"a":1}`},
+		},
+		{
+			name:   "skips other fields and comments",
+			stream: ": keep-alive\nevent: message_start\nid: 1\ndata: x\n\n",
+			want:   []string{"x"},
+		},
+		{
+			name:   "skips empty data and done",
+			stream: "data:\n\ndata: [DONE]\n\n",
+			want:   nil,
+		},
+		{
+			name:   "crlf line endings",
+			stream: "data: x\r\n\r\ndata: y\r\n\r\n",
+			want:   []string{"x", "y"},
+		},
+		{
+			name:   "no trailing newline",
+			stream: "data: x",
+			want:   []string{"x"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := readEvents(strings.NewReader(tt.stream), func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEventsStopsOnError(t *testing.T) {
+	errStop := errors.New("stop")
+
+	calls := 0
+	err := readEvents(strings.NewReader("data: 1\n\ndata: 2\n\n"), func(data []byte) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("got error %v; want %v", err, errStop)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls; want 1", calls)
+	}
+}
+
+func TestStreamContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		newProvider func(baseURL string) Provider
+		stream      string
+	}{
+		{
+			name: "gemini",
+			newProvider: func(baseURL string) Provider {
+				return &GeminiClient{APIKey: "key", Model: "m", BaseURL: baseURL, Timeout: defaultTimeout}
+			},
+			stream: `data: {"candidates": [{"content": {"parts": [{"text": "Good"}]}}]}
+
+data: {"candidates": [{"content": {"parts": [{"text": "bye"}]}}], "usageMetadata": {"promptTokenCount": 7, "candidatesTokenCount": 2}}
+
+`,
+		},
+		{
+			name: "openai",
+			newProvider: func(baseURL string) Provider {
+				return NewOpenAIClient("", "", baseURL)
+			},
+			stream: `data: {"choices": [{"delta": {"role": "assistant"}}]}
+
+data: {"choices": [{"delta": {"content": "Good"}}]}
+
+data: {"choices": [{"delta": {"content": "bye"}, "finish_reason": "stop"}]}
+
+data: {"choices": [], "usage": {"prompt_tokens": 7, "completion_tokens": 2}}
+
+data: [DONE]
+
+`,
+		},
+		{
+			name: "anthropic",
+			newProvider: func(baseURL string) Provider {
+				return NewAnthropicClient("key", "", baseURL)
+			},
+			stream: `event: message_start
+data: {"type": "message_start", "message": {"usage": {"input_tokens": 7, "output_tokens": 1}}}
+
+event: content_block_delta
+data: {"type": "content_block_delta", "delta": {"type": "text_delta", "text": "Good"}}
+
+event: content_block_delta
+data: {"type": "content_block_delta", "delta": {"type": "input_json_delta"}}
+
+event: content_block_delta
+data: {"type": "content_block_delta", "delta": {"type": "text_delta", "text": "bye"}}
+
+event: message_delta
+data: {"type": "message_delta", "usage": {"output_tokens": 2}}
+
+event: message_stop
+data: {"type": "message_stop"}
+
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.stream)
+			}))
+			defer ts.Close()
+
+			var chunks []string
+			got, usage, err := tt.newProvider(ts.URL).StreamContent(context.Background(), conversationFixture, Options{}, func(chunk string) error {
+				chunks = append(chunks, chunk)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "Goodbye" {
+				t.Errorf("got %q; want %q", got, "Goodbye")
+			}
+			if !slices.Equal(chunks, []string{"Good", "bye"}) {
+				t.Errorf("got chunks %q; want %q", chunks, []string{"Good", "bye"})
+			}
+			if want := (Usage{InputTokens: 7, OutputTokens: 2}); usage != want {
+				t.Errorf("got usage %+v; want %+v", usage, want)
+			}
+		})
+	}
+}
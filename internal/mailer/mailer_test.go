@@ -0,0 +1,200 @@
+package mailer
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	m := Mailer{sender: "Cautious Tree <no-reply@example.com>"}
+
+	// Line breaks in text parts are sent as CRLF.
+	plain := "Your token is ABC.\r\n" + strings.Repeat("long line ", 20)
+	html := "<p>Your token is <b>ABC</b>. Grüße</p>"
+
+	raw, err := m.message("alice@example.com", "Réinitialiser", []byte(plain), []byte(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Header.Get("From"); got != m.sender {
+		t.Errorf("got From %q; want %q", got, m.sender)
+	}
+	if got := msg.Header.Get("To"); got != "alice@example.com" {
+		t.Errorf("got To %q; want %q", got, "alice@example.com")
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Réinitialiser" {
+		t.Errorf("got Subject %q, %v; want %q", subject, err, "Réinitialiser")
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("invalid Date: %v", err)
+	}
+
+	parts := readParts(t, msg)
+	want := map[string]string{
+		"text/plain; charset=UTF-8": plain,
+		"text/html; charset=UTF-8":  html,
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("got %d parts; want %d", len(parts), len(want))
+	}
+	for contentType, content := range want {
+		if parts[contentType] != content {
+			t.Errorf("%s: got %q; want %q", contentType, parts[contentType], content)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	addr, received := smtpServer(t)
+
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	m := New(host, portNumber, "", "", "Cautious Tree <no-reply@example.com>")
+
+	err := m.Send("alice@example.com", "token_password_reset.tmpl", map[string]any{
+		"passwordResetToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	if got.from != "no-reply@example.com" {
+		t.Errorf("got envelope sender %q; want %q", got.from, "no-reply@example.com")
+	}
+	if len(got.to) != 1 || got.to[0] != "alice@example.com" {
+		t.Errorf("got envelope recipients %q; want %q", got.to, "alice@example.com")
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for contentType, content := range readParts(t, msg) {
+		if !strings.Contains(content, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			t.Errorf("%s part does not contain the token", contentType)
+		}
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	m := New("localhost", 1, "", "", "no-reply@example.com")
+
+	if err := m.Send("alice@example.com", "missing.tmpl", nil); err == nil {
+		t.Error("got no error for a missing template")
+	}
+}
+
+// readParts returns the decoded content of each part of a multipart
+// message, keyed by content type.
+func readParts(t *testing.T, msg *mail.Message) map[string]string {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q, %v; want multipart/alternative", mediaType, err)
+	}
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[part.Header.Get("Content-Type")] = string(content)
+	}
+
+	return parts
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer accepts a single SMTP session and sends the message it
+// receives on the returned channel.
+func smtpServer(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan smtpMessage, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		var msg smtpMessage
+
+		tc.PrintfLine("220 localhost")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				tc.PrintfLine("250 localhost")
+			case "MAIL":
+				msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+				tc.PrintfLine("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				tc.PrintfLine("250 OK")
+			case "DATA":
+				tc.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				data, err := io.ReadAll(bufio.NewReader(tc.DotReader()))
+				if err != nil {
+					return
+				}
+				msg.data = string(data)
+				tc.PrintfLine("250 OK")
+				received <- msg
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("502 Command not implemented")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
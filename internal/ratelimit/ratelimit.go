@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter keyed by an arbitrary string such
+// as an IP address or a user ID. Each key gets its own bucket holding up to
+// burst tokens which refills at rps tokens per second.
+type Limiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Result describes the state of a bucket after a call to Allow.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time until the next token is available. It is zero
+	// when the request was allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+func New(rps float64, burst int) *Limiter {
+	return &Limiter{
+		rps:     rps,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket for key if one is available.
+func (l *Limiter) Allow(key string) Result {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.burst), lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.lastSeen).Seconds()*l.rps)
+	b.lastSeen = now
+
+	result := Result{Limit: l.burst}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(1 - b.tokens)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = l.duration(float64(l.burst) - b.tokens)
+
+	return result
+}
+
+// Cleanup forgets keys that have not been seen for longer than maxIdle.
+func (l *Limiter) Cleanup(maxIdle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.lastSeen) > maxIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// duration returns how long it takes to refill n tokens.
+func (l *Limiter) duration(n float64) time.Duration {
+	if l.rps <= 0 {
+		return 0
+	}
+	return time.Duration(n / l.rps * float64(time.Second))
+}
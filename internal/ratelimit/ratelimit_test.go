@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		rps   float64
+		burst int
+		calls int
+		// want holds the expected Allowed and Remaining of each call.
+		want []Result
+	}{
+		{
+			name:  "within burst",
+			rps:   1,
+			burst: 3,
+			calls: 3,
+			want: []Result{
+				{Allowed: true, Remaining: 2},
+				{Allowed: true, Remaining: 1},
+				{Allowed: true, Remaining: 0},
+			},
+		},
+		{
+			name:  "over burst",
+			rps:   1,
+			burst: 2,
+			calls: 4,
+			want: []Result{
+				{Allowed: true, Remaining: 1},
+				{Allowed: true, Remaining: 0},
+				{Allowed: false, Remaining: 0},
+				{Allowed: false, Remaining: 0},
+			},
+		},
+		{
+			name:  "zero burst",
+			rps:   1,
+			burst: 0,
+			calls: 1,
+			want: []Result{
+				{Allowed: false, Remaining: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rps, tt.burst)
+
+			for i := range tt.calls {
+				got := l.Allow("key")
+
+				if got.Allowed != tt.want[i].Allowed || got.Remaining != tt.want[i].Remaining {
+					t.Errorf("call %d: got allowed %v, remaining %d; want %v, %d",
+						i+1, got.Allowed, got.Remaining, tt.want[i].Allowed, tt.want[i].Remaining)
+				}
+				if got.Limit != tt.burst {
+					t.Errorf("call %d: got limit %d; want %d", i+1, got.Limit, tt.burst)
+				}
+				if got.Allowed && got.RetryAfter != 0 {
+					t.Errorf("call %d: got retry after %v on an allowed call", i+1, got.RetryAfter)
+				}
+				if !got.Allowed && got.RetryAfter <= 0 {
+					t.Errorf("call %d: got retry after %v on a denied call", i+1, got.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowKeys(t *testing.T) {
+	l := New(1, 1)
+
+	if !l.Allow("a").Allowed {
+		t.Fatal(`Allow("a"): denied on a full bucket`)
+	}
+	if l.Allow("a").Allowed {
+		t.Fatal(`Allow("a"): allowed on an empty bucket`)
+	}
+	if !l.Allow("b").Allowed {
+		t.Fatal(`Allow("b"): shares a bucket with "a"`)
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l := New(2, 2)
+	l.Allow("key")
+	l.Allow("key")
+
+	// Half a second at 2 tokens per second refills one token.
+	l.buckets["key"].lastSeen = time.Now().Add(-500 * time.Millisecond)
+
+	got := l.Allow("key")
+	if !got.Allowed {
+		t.Fatal("Allow: denied after a refill")
+	}
+	if got.Reset <= 0 || got.Reset > time.Second {
+		t.Errorf("Allow: got reset %v; want within a second", got.Reset)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := New(1, 1)
+	l.Allow("idle")
+	l.Allow("active")
+	l.buckets["idle"].lastSeen = time.Now().Add(-time.Hour)
+
+	l.Cleanup(time.Minute)
+
+	if _, found := l.buckets["idle"]; found {
+		t.Error(`Cleanup: kept the "idle" bucket`)
+	}
+	if _, found := l.buckets["active"]; !found {
+		t.Error(`Cleanup: removed the "active" bucket`)
+	}
+}
@@ -0,0 +1,187 @@
+package sessioncache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"misc.sahilsasane.net/internal/llm"
+	"misc.sahilsasane.net/internal/metrics"
+)
+
+var (
+	lookupsTotal = metrics.NewCounterVec(
+		"session_cache_lookups_total",
+		"Chat session cache lookups by result.",
+		"result",
+	)
+	evictionsTotal = metrics.NewCounterVec(
+		"session_cache_evictions_total",
+		"Chat sessions removed from the cache by reason.",
+		"reason",
+	)
+)
+
+// Cache holds the chat sessions rebuilt from stored message history, keyed
+// by session ID. It keeps at most capacity entries, evicting the least
+// recently used one when full, and drops entries that have not been used
+// for longer than ttl.
+//
+// A cached chat is not safe for concurrent use. Callers that modify one must
+// hold the session's lock, taken with TryLock.
+type Cache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	busy  map[string]struct{}
+}
+
+type entry struct {
+	key      string
+	chat     *llm.ChatSession
+	lastUsed time.Time
+}
+
+// New returns a cache holding up to capacity sessions. A capacity of zero or
+// less disables the size bound and a ttl of zero disables idle expiry.
+func New(capacity int, ttl time.Duration) *Cache {
+	return &Cache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		busy:     make(map[string]struct{}),
+	}
+}
+
+// Get returns the cached chat for key and marks it as recently used.
+func (c *Cache) Get(key string) (*llm.ChatSession, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		lookupsTotal.Inc("miss")
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if c.expired(e, now) {
+		c.remove(el, "expired")
+		lookupsTotal.Inc("miss")
+		return nil, false
+	}
+
+	e.lastUsed = now
+	c.order.MoveToFront(el)
+	lookupsTotal.Inc("hit")
+	return e.chat, true
+}
+
+// Set stores chat under key, evicting the least recently used entry if the
+// cache is full.
+func (c *Cache) Set(key string, chat *llm.ChatSession) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[key]; found {
+		e := el.Value.(*entry)
+		e.chat = chat
+		e.lastUsed = now
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry{key: key, chat: chat, lastUsed: now})
+
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		c.remove(c.order.Back(), "capacity")
+	}
+}
+
+// Invalidate removes the given keys so that the next Get rebuilds them from
+// the database. It should be called whenever a session's stored history
+// changes outside of the cached chat.
+func (c *Cache) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, found := c.items[key]; found {
+			c.remove(el, "invalidated")
+		}
+	}
+}
+
+// Cleanup removes every entry that has been idle for longer than the ttl
+// and returns the number removed.
+func (c *Cache) Cleanup() int {
+	if c.ttl <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	// Entries are ordered by last use, so stop at the first live one.
+	for el := c.order.Back(); el != nil; el = c.order.Back() {
+		if !c.expired(el.Value.(*entry), now) {
+			break
+		}
+		c.remove(el, "expired")
+		removed++
+	}
+
+	return removed
+}
+
+// TryLock marks key as busy. It returns false, without blocking, when the
+// key is already held by someone else. Locks are independent of the cached
+// entries and survive eviction.
+func (c *Cache) TryLock(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, held := c.busy[key]; held {
+		return false
+	}
+	c.busy[key] = struct{}{}
+	return true
+}
+
+// Unlock releases a lock taken with TryLock.
+func (c *Cache) Unlock(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.busy, key)
+}
+
+// Len returns the number of cached sessions, including expired entries that
+// have not been cleaned up yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache) expired(e *entry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(e.lastUsed) > c.ttl
+}
+
+func (c *Cache) remove(el *list.Element, reason string) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+	evictionsTotal.Inc(reason)
+}
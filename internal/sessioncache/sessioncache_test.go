@@ -0,0 +1,245 @@
+package sessioncache
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"misc.sahilsasane.net/internal/llm"
+)
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		// ops are applied in order: "+k" sets k and "?k" gets it.
+		ops     []string
+		want    []string
+		evicted []string
+	}{
+		{
+			name:     "under capacity",
+			capacity: 3,
+			ops:      []string{"+a", "+b"},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "evicts least recently set",
+			capacity: 2,
+			ops:      []string{"+a", "+b", "+c"},
+			want:     []string{"b", "c"},
+			evicted:  []string{"a"},
+		},
+		{
+			name:     "get marks as recently used",
+			capacity: 2,
+			ops:      []string{"+a", "+b", "?a", "+c"},
+			want:     []string{"a", "c"},
+			evicted:  []string{"b"},
+		},
+		{
+			name:     "set of an existing key does not evict",
+			capacity: 2,
+			ops:      []string{"+a", "+b", "+a"},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "no capacity means no bound",
+			capacity: 0,
+			ops:      []string{"+a", "+b", "+c", "+d"},
+			want:     []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(tt.capacity, 0)
+
+			for _, op := range tt.ops {
+				switch key := op[1:]; op[0] {
+				case '+':
+					c.Set(key, &llm.ChatSession{})
+				case '?':
+					c.Get(key)
+				}
+			}
+
+			for _, key := range tt.want {
+				if _, found := c.Get(key); !found {
+					t.Errorf("Get(%q): not found, want found", key)
+				}
+			}
+			for _, key := range tt.evicted {
+				if _, found := c.Get(key); found {
+					t.Errorf("Get(%q): found, want evicted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestSetReplacesChat(t *testing.T) {
+	c := New(1, 0)
+
+	first, second := &llm.ChatSession{}, &llm.ChatSession{}
+	c.Set("a", first)
+	c.Set("a", second)
+
+	got, found := c.Get("a")
+	if !found || got != second {
+		t.Fatalf("Get: got %p, %v; want %p, true", got, found, second)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len: got %d; want 1", c.Len())
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c := New(0, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, &llm.ChatSession{})
+	}
+
+	c.Invalidate("a", "c", "missing")
+
+	if c.Len() != 1 {
+		t.Errorf("Len: got %d; want 1", c.Len())
+	}
+	if _, found := c.Get("b"); !found {
+		t.Error(`Get("b"): not found, want found`)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		idle        []time.Duration
+		wantRemoved int
+		wantLen     int
+	}{
+		{
+			name:        "removes idle entries",
+			ttl:         time.Minute,
+			idle:        []time.Duration{3 * time.Minute, 2 * time.Minute, time.Second},
+			wantRemoved: 2,
+			wantLen:     1,
+		},
+		{
+			name:        "keeps live entries",
+			ttl:         time.Minute,
+			idle:        []time.Duration{30 * time.Second, time.Second},
+			wantRemoved: 0,
+			wantLen:     2,
+		},
+		{
+			name:        "no ttl keeps everything",
+			ttl:         0,
+			idle:        []time.Duration{24 * time.Hour, time.Hour},
+			wantRemoved: 0,
+			wantLen:     2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(0, tt.ttl)
+			backdate(c, tt.idle)
+
+			if removed := c.Cleanup(); removed != tt.wantRemoved {
+				t.Errorf("Cleanup: got %d; want %d", removed, tt.wantRemoved)
+			}
+			if c.Len() != tt.wantLen {
+				t.Errorf("Len: got %d; want %d", c.Len(), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	c := New(0, time.Minute)
+	backdate(c, []time.Duration{2 * time.Minute})
+
+	if _, found := c.Get("0"); found {
+		t.Error("Get: found an expired entry")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len: got %d; want 0", c.Len())
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	c := New(1, 0)
+
+	if !c.TryLock("a") {
+		t.Fatal("TryLock: got false on a free key")
+	}
+	if c.TryLock("a") {
+		t.Fatal("TryLock: got true on a held key")
+	}
+	if !c.TryLock("b") {
+		t.Fatal("TryLock: a held key blocked another key")
+	}
+
+	// Locks outlive the entries they guard.
+	c.Set("a", &llm.ChatSession{})
+	c.Set("b", &llm.ChatSession{})
+	if c.TryLock("a") {
+		t.Fatal("TryLock: eviction released the lock")
+	}
+
+	c.Unlock("a")
+	if !c.TryLock("a") {
+		t.Fatal("TryLock: got false after Unlock")
+	}
+}
+
+func TestTryLockConcurrentSends(t *testing.T) {
+	c := New(10, 0)
+
+	const senders = 50
+	var (
+		wg      sync.WaitGroup
+		start   = make(chan struct{})
+		winners atomic.Int32
+	)
+
+	// Every sender tries to take the session while the others still hold
+	// or contend for it, so exactly one of them must get through.
+	for range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if c.TryLock("session") {
+				winners.Add(1)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	if got := winners.Load(); got != 1 {
+		t.Fatalf("got %d senders holding the lock; want 1", got)
+	}
+
+	c.Unlock("session")
+	if !c.TryLock("session") {
+		t.Fatal("TryLock: got false once the winner released the lock")
+	}
+}
+
+// backdate adds an entry per element of idle, keyed by its index, as if it
+// was last used that long ago. idle must be in decreasing order, matching
+// the order in which Set would have added the entries.
+func backdate(c *Cache, idle []time.Duration) {
+	now := time.Now()
+	for i, d := range idle {
+		key := strconv.Itoa(i)
+		c.Set(key, &llm.ChatSession{})
+		c.items[key].Value.(*entry).lastUsed = now.Add(-d)
+	}
+}